@@ -0,0 +1,75 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// afkWarning is how long before cfg.afkTimeout an idle player is warned.
+const afkWarning = 10 * time.Second
+
+type wsOutAFK struct {
+	Side    int `json:"side"`
+	Seconds int `json:"seconds"` // until the kick; 0 once kicked
+}
+
+// afkForLocked returns how long side's player has gone without steering
+// during play. Time spent paused, between sets or before the serve doesn't
+// count.
+func (r *room) afkForLocked(side int, now time.Time) time.Duration {
+	since := r.activeSince
+	if t := time.Unix(0, r.players[side].lastMove.Load()); t.After(since) {
+		since = t
+	}
+	return now.Sub(since)
+}
+
+// checkAFKLocked warns a player in play who has stopped sending input and,
+// if they still don't move, forfeits the match for them and queues them to
+// be disconnected so their slot is freed. Bots and spectators are exempt.
+func (r *room) checkAFKLocked(now time.Time) {
+	if r.phase != phasePlaying {
+		return
+	}
+	for side := 0; side < 2; side++ {
+		p := r.players[side]
+		if p == nil {
+			continue
+		}
+		idle := r.afkForLocked(side, now)
+		switch {
+		case idle >= r.cfg.afkTimeout:
+			r.outbox = append(r.outbox, wsOut{Type: "afk", Data: wsOutAFK{Side: side}})
+			r.finishAsLocked("afk", 1-side)
+			r.kick = append(r.kick, p)
+			return
+		case idle >= r.cfg.afkTimeout-afkWarning:
+			if !r.afkWarned[side] {
+				r.afkWarned[side] = true
+				left := (r.cfg.afkTimeout - idle).Round(time.Second)
+				r.outbox = append(r.outbox, wsOut{Type: "afk_warning", Data: wsOutAFK{Side: side, Seconds: int(left.Seconds())}})
+			}
+		default:
+			r.afkWarned[side] = false
+		}
+	}
+}
+
+// takeKicked returns and clears the players to disconnect.
+func (r *room) takeKicked() []*client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := r.kick
+	r.kick = nil
+	return out
+}
+
+// kickAFK closes an AFK player's connection once the gameover has had a
+// moment to flush. The match is already over, so the disconnect frees their
+// slot instead of holding it for resume.
+func kickAFK(c *client) {
+	time.AfterFunc(shutdownFlush, func() {
+		closeConn(c, websocket.ClosePolicyViolation, "afk")
+	})
+}
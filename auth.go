@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Identity is a verified user, as read from a bearer token.
+type Identity struct {
+	UserID string
+	Name   string
+}
+
+// Verifier checks the bearer token a client presents on connect. Deployments
+// can plug in their own scheme; hmacVerifier covers HS256 JWTs.
+type Verifier interface {
+	Verify(token string) (Identity, error)
+}
+
+var errInvalidToken = errors.New("invalid token")
+
+// newVerifier picks the verifier for cfg, or nil if tokens aren't checked
+// and everyone plays anonymously.
+func newVerifier(cfg config) Verifier {
+	if cfg.authSecret == "" {
+		return nil
+	}
+	return hmacVerifier{secret: []byte(cfg.authSecret)}
+}
+
+// bearerToken returns the token from the Authorization header, or from the
+// token query parameter since browsers can't set headers on a WebSocket.
+func bearerToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); h != "" {
+		if tok, ok := strings.CutPrefix(h, "Bearer "); ok {
+			return strings.TrimSpace(tok)
+		}
+	}
+	return r.URL.Query().Get("token")
+}
+
+// hmacVerifier accepts HS256 JWTs signed with secret. The user id is the
+// sub claim and the display name the name claim; exp and nbf are enforced
+// when present.
+type hmacVerifier struct {
+	secret []byte
+}
+
+type jwtClaims struct {
+	Sub  string `json:"sub"`
+	Name string `json:"name"`
+	Exp  int64  `json:"exp"`
+	Nbf  int64  `json:"nbf"`
+}
+
+func (v hmacVerifier) Verify(token string) (Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Identity{}, errInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return Identity{}, errInvalidToken
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Identity{}, errInvalidToken
+	}
+	mac := hmac.New(sha256.New, v.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return Identity{}, errInvalidToken
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil || claims.Sub == "" {
+		return Identity{}, errInvalidToken
+	}
+	now := time.Now().Unix()
+	if (claims.Exp != 0 && now >= claims.Exp) || (claims.Nbf != 0 && now < claims.Nbf) {
+		return Identity{}, errInvalidToken
+	}
+	return Identity{UserID: claims.Sub, Name: claims.Name}, nil
+}
+
+func decodeJWTPart(s string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
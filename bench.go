@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// maxBenchRooms bounds how many bench rooms one request may make.
+const maxBenchRooms = 1000
+
+// createBenchRoom makes a room where two bots play each other, watched by
+// the given number of dummy spectators, for load testing. Dummies have no
+// connection; a goroutine throws away everything sent to them until the
+// room closes. Bench rooms are never matchmade, listed in GET /rooms, picked
+// for live spectating or closed as idle, record no results and restart as
+// soon as a match ends.
+func (h *hub) createBenchRoom(spectators int) (*room, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.fullLocked() {
+		return nil, errServerFull
+	}
+	r := h.newRoomLocked()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bench = true
+	r.results, r.ratings = nil, nil
+	r.bot = [2]bool{true, true}
+	for i := range spectators {
+		c := &client{
+			id:   r.id + "-s" + strconv.Itoa(i),
+			send: make(chan outFrame, 64),
+			side: -1,
+		}
+		c.mouseY.Store(mouseUnused)
+		go func() {
+			for range c.send {
+			}
+		}()
+		h.addSpectatorLocked(r, c)
+	}
+	return r, nil
+}
+
+// handleBenchRooms makes count bench rooms, each with spectators dummy
+// spectators, and answers with their ids. It stops early at the room limit,
+// failing only if no room was made. Like the room dump it is only routed
+// with DEBUG_ENDPOINTS set and only answers the server's own host.
+func handleBenchRooms(w http.ResponseWriter, r *http.Request) {
+	if !fromLoopback(r, globalHub.cfg.trustProxy) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	q := r.URL.Query()
+	count, err := strconv.Atoi(q.Get("count"))
+	if err != nil || count < 1 || count > maxBenchRooms {
+		http.Error(w, "count must be between 1 and "+strconv.Itoa(maxBenchRooms), http.StatusBadRequest)
+		return
+	}
+	spectators := 0
+	if s := q.Get("spectators"); s != "" {
+		spectators, err = strconv.Atoi(s)
+		if err != nil || spectators < 0 || spectators > globalHub.cfg.maxSpectators {
+			http.Error(w, "spectators must be between 0 and "+strconv.Itoa(globalHub.cfg.maxSpectators), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ids := make([]string, 0, count)
+	for range count {
+		room, err := globalHub.createBenchRoom(spectators)
+		if err != nil {
+			break
+		}
+		ids = append(ids, room.id)
+	}
+	if len(ids) == 0 {
+		http.Error(w, errServerFull.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(ids)
+}
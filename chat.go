@@ -0,0 +1,179 @@
+package main
+
+import (
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxChatBytes caps the size of a relayed chat message.
+const maxChatBytes = 280
+
+// maxNameRunes caps the length of a display name.
+const maxNameRunes = 24
+
+// Minimum gap between one client's chat messages. Spectators get a longer
+// one so a crowded room can't drown out the players.
+const (
+	playerChatInterval    = 500 * time.Millisecond
+	spectatorChatInterval = 2 * time.Second
+)
+
+type wsInChat struct {
+	Text string `json:"text"`
+}
+
+type wsOutChat struct {
+	Name string `json:"name"`
+	Side int    `json:"side"`
+	Text string `json:"text"`
+}
+
+// reactions are the codes a "react" message may carry.
+var reactions = map[string]bool{
+	"gg":    true,
+	"wow":   true,
+	"lol":   true,
+	"nice":  true,
+	"oops":  true,
+	"close": true,
+}
+
+type wsInReact struct {
+	Code string `json:"code"`
+}
+
+type wsOutReaction struct {
+	Name string `json:"name"`
+	Side int    `json:"side"`
+	Code string `json:"code"`
+}
+
+// paddleColors are the colors a player may pick; the web client maps each
+// to its own shade.
+var paddleColors = map[string]bool{
+	"white":  true,
+	"red":    true,
+	"orange": true,
+	"yellow": true,
+	"green":  true,
+	"cyan":   true,
+	"blue":   true,
+	"purple": true,
+	"pink":   true,
+}
+
+// defaultColor is the color of anyone who hasn't picked one, and the bot.
+const defaultColor = "white"
+
+// setColor changes c's paddle color. An empty color leaves it unchanged; one
+// outside paddleColors is rejected.
+func (c *client) setColor(color string) bool {
+	if color == "" {
+		return true
+	}
+	if !paddleColors[color] {
+		return false
+	}
+	c.seatMu.Lock()
+	c.color = color
+	c.seatMu.Unlock()
+	return true
+}
+
+// displayColor is c's paddle color, or defaultColor if it hasn't picked one.
+func (c *client) displayColor() string {
+	c.seatMu.Lock()
+	defer c.seatMu.Unlock()
+	if c.color != "" {
+		return c.color
+	}
+	return defaultColor
+}
+
+// setName changes c's display name. Signed-in clients keep the name from
+// their token.
+func (c *client) setName(name string) {
+	if c.userID != "" {
+		return
+	}
+	name = sanitizeName(name)
+	c.seatMu.Lock()
+	c.name = name
+	c.seatMu.Unlock()
+}
+
+// profile returns c's chosen name and color, either empty if unset.
+func (c *client) profile() (name, color string) {
+	c.seatMu.Lock()
+	defer c.seatMu.Unlock()
+	return c.name, c.color
+}
+
+// allowChat reports whether c may chat at now, and if so starts its cooldown.
+// Only readPump calls it.
+func (c *client) allowChat(now time.Time) bool {
+	return c.cooldown(&c.lastChat, now)
+}
+
+// allowReaction is allowChat for reactions, which have their own cooldown.
+func (c *client) allowReaction(now time.Time) bool {
+	return c.cooldown(&c.lastReact, now)
+}
+
+func (c *client) cooldown(last *time.Time, now time.Time) bool {
+	interval := playerChatInterval
+	if _, side := c.seat(); side < 0 {
+		interval = spectatorChatInterval
+	}
+	if !last.IsZero() && now.Sub(*last) < interval {
+		return false
+	}
+	*last = now
+	return true
+}
+
+// sanitizeChat strips control characters and surrounding whitespace and
+// truncates to maxChatBytes without splitting a UTF-8 sequence.
+func sanitizeChat(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, s)
+	s = strings.TrimSpace(s)
+	if len(s) <= maxChatBytes {
+		return s
+	}
+	cut := maxChatBytes
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return strings.TrimSpace(s[:cut])
+}
+
+// sanitizeName trims a display name, drops control characters and angle
+// brackets, and caps it at maxNameRunes runes. An empty result means the
+// client keeps showing its id.
+func sanitizeName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError || r == '<' || r == '>' {
+			return -1
+		}
+		return r
+	}, s)
+	s = strings.TrimSpace(s)
+	if utf8.RuneCountInString(s) <= maxNameRunes {
+		return s
+	}
+	n := 0
+	for i := range s {
+		if n == maxNameRunes {
+			return strings.TrimSpace(s[:i])
+		}
+		n++
+	}
+	return s
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Defaults for the startup configuration.
+const (
+	defaultTickRate      = 60
+	defaultWorldW        = 800
+	defaultWorldH        = 600
+	defaultMatchDuration = 5 * time.Minute
+	defaultPingInterval  = 10 * time.Second
+	defaultMaxSpectators = 50
+	defaultIdleTimeout   = 2 * time.Minute
+	defaultAFKTimeout    = 45 * time.Second
+	defaultMaxRooms      = 1000
+	defaultMaxTourRooms  = 100
+	defaultShards        = 1
+	defaultOrphanGrace   = 30 * time.Second
+	defaultMaxRoomAge    = 30 * time.Minute
+	defaultMaxConnsPerIP = 20
+	defaultSets          = 1
+	defaultBalls         = 1
+	maxBalls             = 3
+	defaultServeDelay    = time.Second
+	maxServeDelay        = 5 * time.Second
+)
+
+// config holds server-wide settings read once at startup.
+type config struct {
+	tickRate      int
+	broadcastHz   int // state frames per second; at most tickRate
+	shards        int // game loop goroutines; rooms are split between them
+	worldW        float64
+	worldH        float64
+	matchDuration time.Duration // per set
+	sets          int           // best of this many sets
+	swapPerSet    bool          // players change ends after each set
+	swapPoints    int           // players change ends every this many points; 0 never
+	powerups      bool          // spawn power-ups on the field
+	balls         int           // balls in play at once
+	recordInputs  bool          // keep each match's inputs for replay
+	tlsCert       string        // with tlsKey, serve HTTPS and WSS directly
+	tlsKey        string
+	serveMode     serveMode
+	serveDelay    time.Duration // ball held centered after each round reset; 0 serves at once
+	resultsFile   string        // JSON-lines match log; empty keeps results in memory
+	compression   bool          // offer permessage-deflate on the WebSocket upgrade
+	pingInterval  time.Duration
+	maxSpectators int           // per room; every spectator is sent every state frame
+	maxRooms      int           // rooms open at once; the game loop ticks every one
+	maxTourRooms  int           // of those, how many tournament matches may hold
+	idleTimeout   time.Duration // close rooms that aren't playing and get no input
+	orphanGrace   time.Duration // close rooms left to spectators after this long
+	maxRoomAge    time.Duration // close any room whose match has gone on this long
+	afkTimeout    time.Duration // forfeit players who stop steering mid-match
+	authSecret    string        // HS256 key for bearer tokens; empty disables sign-in
+	maxConnsPerIP int           // open WebSockets per remote IP; 0 no limit
+	trustProxy    bool          // take the remote IP from X-Forwarded-For
+	allowNoOrigin bool          // accept WebSocket upgrades that send no Origin header
+	debug         bool          // serve /debug/room/{id} to localhost and accept debug_ messages
+}
+
+func defaultConfig() config {
+	return config{
+		tickRate:      defaultTickRate,
+		broadcastHz:   defaultTickRate,
+		shards:        defaultShards,
+		worldW:        defaultWorldW,
+		worldH:        defaultWorldH,
+		matchDuration: defaultMatchDuration,
+		sets:          defaultSets,
+		balls:         defaultBalls,
+		serveMode:     serveLoser,
+		serveDelay:    defaultServeDelay,
+		compression:   true,
+		pingInterval:  defaultPingInterval,
+		maxSpectators: defaultMaxSpectators,
+		maxRooms:      defaultMaxRooms,
+		maxTourRooms:  defaultMaxTourRooms,
+		idleTimeout:   defaultIdleTimeout,
+		orphanGrace:   defaultOrphanGrace,
+		maxRoomAge:    defaultMaxRoomAge,
+		afkTimeout:    defaultAFKTimeout,
+		maxConnsPerIP: defaultMaxConnsPerIP,
+	}
+}
+
+// loadConfig reads the configuration from the environment. Missing or
+// invalid values keep their defaults.
+func loadConfig() config {
+	cfg := defaultConfig()
+	cfg.tickRate = envInt("TICK_RATE", cfg.tickRate, 1)
+	// State goes out every tick unless BROADCAST_HZ says otherwise.
+	cfg.broadcastHz = envInt("BROADCAST_HZ", cfg.tickRate, 1)
+	if cfg.broadcastHz > cfg.tickRate {
+		log.Printf("BROADCAST_HZ %d is over TICK_RATE %d, using %d", cfg.broadcastHz, cfg.tickRate, cfg.tickRate)
+		cfg.broadcastHz = cfg.tickRate
+	}
+	cfg.shards = envInt("GAME_SHARDS", cfg.shards, 1)
+	// The field must at least fit both paddles and a paddle's height.
+	cfg.worldW = float64(envInt("WORLD_W", int(cfg.worldW), 2*(paddleMargin+paddleW)+4*ballRadius))
+	cfg.worldH = float64(envInt("WORLD_H", int(cfg.worldH), paddleH+1))
+	cfg.matchDuration = envDuration("MATCH_DURATION", cfg.matchDuration)
+	cfg.sets = envInt("SETS", cfg.sets, 1)
+	// Best of an even number can end level, with nobody past a majority.
+	if cfg.sets%2 == 0 {
+		log.Printf("SETS %d must be odd, using %d", cfg.sets, defaultSets)
+		cfg.sets = defaultSets
+	}
+	cfg.resultsFile = os.Getenv("RESULTS_FILE")
+	cfg.authSecret = os.Getenv("AUTH_HMAC_SECRET")
+	cfg.tlsCert, cfg.tlsKey = os.Getenv("TLS_CERT"), os.Getenv("TLS_KEY")
+	if (cfg.tlsCert == "") != (cfg.tlsKey == "") {
+		log.Printf("TLS_CERT and TLS_KEY must be set together, serving plain HTTP")
+		cfg.tlsCert, cfg.tlsKey = "", ""
+	}
+	cfg.maxSpectators = envInt("MAX_SPECTATORS", cfg.maxSpectators, 0)
+	cfg.maxRooms = envInt("MAX_ROOMS", cfg.maxRooms, 1)
+	cfg.maxTourRooms = envInt("MAX_TOURNAMENT_ROOMS", cfg.maxTourRooms, 1)
+	cfg.idleTimeout = envDuration("IDLE_TIMEOUT", cfg.idleTimeout)
+	cfg.orphanGrace = envDuration("ORPHAN_GRACE", cfg.orphanGrace)
+	cfg.maxRoomAge = envDuration("MAX_ROOM_AGE", cfg.maxRoomAge)
+	// A full series must fit, with room to spare for breaks and overtime.
+	if series := time.Duration(cfg.sets) * cfg.matchDuration; cfg.maxRoomAge <= series {
+		log.Printf("MAX_ROOM_AGE %s must be over SETS × MATCH_DURATION %s, using %s", cfg.maxRoomAge, series, series+defaultMaxRoomAge)
+		cfg.maxRoomAge = series + defaultMaxRoomAge
+	}
+	cfg.afkTimeout = envDuration("AFK_TIMEOUT", cfg.afkTimeout)
+	if cfg.afkTimeout <= afkWarning {
+		log.Printf("AFK_TIMEOUT %s must be over %s, using %s", cfg.afkTimeout, afkWarning, defaultAFKTimeout)
+		cfg.afkTimeout = defaultAFKTimeout
+	}
+	cfg.powerups = envBool("POWERUPS", cfg.powerups)
+	cfg.recordInputs = envBool("RECORD_INPUTS", cfg.recordInputs)
+	cfg.balls = envInt("BALLS", cfg.balls, 1)
+	if cfg.balls > maxBalls {
+		log.Printf("BALLS %d is over %d, using %d", cfg.balls, maxBalls, maxBalls)
+		cfg.balls = maxBalls
+	}
+	// envDuration rejects zero, which here means serving without a pause.
+	if d, err := time.ParseDuration(os.Getenv("SERVE_DELAY")); err == nil && d == 0 {
+		cfg.serveDelay = 0
+	} else {
+		cfg.serveDelay = envDuration("SERVE_DELAY", cfg.serveDelay)
+	}
+	if cfg.serveDelay > maxServeDelay {
+		log.Printf("SERVE_DELAY %s is over %s, using %s", cfg.serveDelay, maxServeDelay, maxServeDelay)
+		cfg.serveDelay = maxServeDelay
+	}
+	cfg.maxConnsPerIP = envInt("MAX_CONNS_PER_IP", cfg.maxConnsPerIP, 0)
+	cfg.trustProxy = envBool("TRUST_PROXY", cfg.trustProxy)
+	cfg.allowNoOrigin = envBool("ALLOW_EMPTY_ORIGIN", cfg.allowNoOrigin)
+	cfg.debug = envBool("DEBUG_ENDPOINTS", cfg.debug)
+	cfg.compression = envBool("WS_COMPRESSION", cfg.compression)
+	cfg.pingInterval = envDuration("PING_INTERVAL", cfg.pingInterval)
+	if cfg.pingInterval >= readTimeout {
+		log.Printf("PING_INTERVAL %s must be under %s, using %s", cfg.pingInterval, readTimeout, defaultPingInterval)
+		cfg.pingInterval = defaultPingInterval
+	}
+
+	if v := os.Getenv("SWAP_SIDES"); v != "" {
+		perSet, points, ok := parseSwapSides(v)
+		if !ok {
+			log.Printf("invalid SWAP_SIDES %q, not swapping", v)
+		}
+		cfg.swapPerSet, cfg.swapPoints = perSet, points
+	}
+	if v := os.Getenv("SERVE_MODE"); v != "" {
+		m, ok := parseServeMode(v)
+		if !ok {
+			log.Printf("unknown SERVE_MODE %q, using loser", v)
+		}
+		cfg.serveMode = m
+	}
+	return cfg
+}
+
+// broadcastEvery is how many ticks apart state frames go out: broadcastHz
+// rounded to a whole number of ticks.
+func (cfg config) broadcastEvery() int {
+	return max(1, int(math.Round(float64(cfg.tickRate)/float64(cfg.broadcastHz))))
+}
+
+// envInt parses an integer environment variable, falling back to def when it
+// is unset, malformed, or below lo.
+func envInt(name string, def, lo int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < lo {
+		log.Printf("invalid %s %q, using %d", name, v, def)
+		return def
+	}
+	return n
+}
+
+// envBool parses a boolean environment variable such as "1" or "false",
+// falling back to def when it is unset or malformed.
+func envBool(name string, def bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("invalid %s %q, using %t", name, v, def)
+		return def
+	}
+	return b
+}
+
+// envDuration parses a duration such as "10m", or a bare number of seconds,
+// falling back to def when it is unset, malformed, or not positive.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		var n int
+		n, err = strconv.Atoi(v)
+		d = time.Duration(n) * time.Second
+	}
+	if err != nil || d <= 0 {
+		log.Printf("invalid %s %q, using %s", name, v, def)
+		return def
+	}
+	return d
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaxRoomAgeFitsSeries(t *testing.T) {
+	t.Setenv("SETS", "5")
+	t.Setenv("MATCH_DURATION", "10m")
+	t.Setenv("MAX_ROOM_AGE", "30m")
+	cfg := loadConfig()
+	if series := 50 * time.Minute; cfg.maxRoomAge <= series {
+		t.Errorf("maxRoomAge = %s, want over the %s a full series can take", cfg.maxRoomAge, series)
+	}
+}
+
+func TestSetsMustBeOdd(t *testing.T) {
+	for _, v := range []string{"0", "-3", "2", "4"} {
+		t.Setenv("SETS", v)
+		if got := loadConfig().sets; got != defaultSets {
+			t.Errorf("SETS=%s gave %d sets, want the default %d", v, got, defaultSets)
+		}
+	}
+	t.Setenv("SETS", "5")
+	if got := loadConfig().sets; got != 5 {
+		t.Errorf("SETS=5 gave %d sets", got)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// debugPlayer is one occupied player slot in a room dump.
+type debugPlayer struct {
+	ClientID string `json:"clientId"`
+	UserID   string `json:"userId,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Side     int    `json:"side"`
+	Away     bool   `json:"away"`
+	Bot      bool   `json:"bot"`
+	Dropped  int64  `json:"dropped"` // frames lost to a full send buffer
+}
+
+type debugBall struct {
+	X       float64 `json:"x"`
+	Y       float64 `json:"y"`
+	VX      float64 `json:"vx"`
+	VY      float64 `json:"vy"`
+	LastHit int     `json:"lastHit"`
+}
+
+// debugRoom is the server's internal view of a room, for GET /debug/room.
+type debugRoom struct {
+	ID           string        `json:"id"`
+	Code         string        `json:"code,omitempty"`
+	Rules        roomConfig    `json:"rules"`
+	Phase        string        `json:"phase"`
+	Overtime     bool          `json:"overtime"`
+	Tick         int           `json:"tick"`
+	Seed         uint64        `json:"seed"`
+	Players      []debugPlayer `json:"players"`
+	Host         string        `json:"host,omitempty"`
+	Spectators   []string      `json:"spectators"`
+	PaddleY      [2]float64    `json:"paddleY"`
+	PaddleH      [2]float64    `json:"paddleH"`
+	Balls        []debugBall   `json:"balls"`
+	Powerups     []powerup     `json:"powerups"`
+	Score        [2]int        `json:"score"`
+	Sets         [2]int        `json:"sets"`
+	Ready        [2]bool       `json:"ready"`
+	Rematch      [2]bool       `json:"rematch"`
+	RallyHits    int           `json:"rallyHits"`
+	LongestRally int           `json:"longestRally"`
+	AckSeq       [2]uint32     `json:"ackSeq"`
+
+	// Timestamps; zero ones are left out.
+	CreatedAt     time.Time  `json:"createdAt"`
+	StartTime     *time.Time `json:"startTime,omitempty"`
+	EndTime       *time.Time `json:"endTime,omitempty"`
+	FinishTime    *time.Time `json:"finishTime,omitempty"`
+	CountdownEnd  *time.Time `json:"countdownEnd,omitempty"`
+	PausedAt      *time.Time `json:"pausedAt,omitempty"`
+	StalledSince  *time.Time `json:"stalledSince,omitempty"`
+	OrphanedSince *time.Time `json:"orphanedSince,omitempty"`
+	ReservedUntil *time.Time `json:"reservedUntil,omitempty"`
+	LastTick      *time.Time `json:"lastTick,omitempty"`
+	LastInput     time.Time  `json:"lastInput"`
+}
+
+// optTime is t, or nil if t is zero.
+func optTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// debugDump captures r's internal state.
+func (r *room) debugDump() debugRoom {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d := debugRoom{
+		ID:            r.id,
+		Code:          r.code,
+		Rules:         r.rules,
+		Phase:         string(r.phase),
+		Overtime:      r.overtime,
+		Tick:          r.tick,
+		Seed:          r.seed,
+		Players:       []debugPlayer{},
+		Spectators:    make([]string, 0, len(r.spectators)),
+		PaddleY:       r.paddleY,
+		PaddleH:       r.paddleLen,
+		Powerups:      append([]powerup{}, r.powerups...),
+		Score:         r.score,
+		Sets:          r.setsWon,
+		Ready:         r.ready,
+		Rematch:       r.rematch,
+		RallyHits:     r.rallyHits,
+		LongestRally:  r.longestRally,
+		AckSeq:        r.ackSeq,
+		CreatedAt:     r.createdAt,
+		StartTime:     optTime(r.startTime),
+		EndTime:       optTime(r.endTime),
+		FinishTime:    optTime(r.finishTime),
+		CountdownEnd:  optTime(r.countdownEnd),
+		PausedAt:      optTime(r.pausedAt),
+		StalledSince:  optTime(r.stalledSince),
+		OrphanedSince: optTime(r.orphanedSince),
+		ReservedUntil: optTime(r.reservedUntil),
+		LastTick:      optTime(r.lastTick),
+		LastInput:     time.Unix(0, r.lastInput.Load()),
+	}
+	for side, p := range r.players {
+		switch {
+		case p != nil:
+			name, _ := p.profile()
+			d.Players = append(d.Players, debugPlayer{
+				ClientID: p.id,
+				UserID:   p.userID,
+				Name:     name,
+				Side:     side,
+				Away:     r.away[side],
+				Dropped:  p.dropped.Load(),
+			})
+		case r.bot[side]:
+			d.Players = append(d.Players, debugPlayer{Side: side, Bot: true})
+		}
+	}
+	if r.host != nil {
+		d.Host = r.host.id
+	}
+	for id := range r.spectators {
+		d.Spectators = append(d.Spectators, id)
+	}
+	for _, b := range r.balls {
+		d.Balls = append(d.Balls, debugBall{X: b.x, Y: b.y, VX: b.vx, VY: b.vy, LastHit: b.lastHit})
+	}
+	return d
+}
+
+// fromLoopback reports whether r was made directly from the server's own
+// host. Behind a trusted proxy on the same host every request arrives from
+// loopback, so with trustProxy a request the proxy forwarded, marked by
+// X-Forwarded-For, is never taken as local.
+func fromLoopback(r *http.Request, trustProxy bool) bool {
+	if trustProxy && r.Header.Get("X-Forwarded-For") != "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+	return err == nil && ip != nil && ip.IsLoopback()
+}
+
+// handleDebugRoom dumps a room's internal state. It is only routed with
+// DEBUG_ENDPOINTS set, and even then only answers requests made directly
+// from the server's own host.
+func handleDebugRoom(w http.ResponseWriter, r *http.Request) {
+	if !fromLoopback(r, globalHub.cfg.trustProxy) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	globalHub.mu.Lock()
+	room := globalHub.rooms[r.PathValue("id")]
+	globalHub.mu.Unlock()
+	if room == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(room.debugDump())
+}
+
+type wsInDebugScore struct {
+	Score [2]int `json:"score"`
+}
+
+var errDebugScore = errors.New("scores must be between 0 and 999")
+
+// debugResetRound re-centers the paddles and serves again without awarding
+// a point. It only acts mid-play. readPump only calls it with
+// DEBUG_ENDPOINTS set.
+func (r *room) debugResetRound() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.phase != phasePlaying {
+		return
+	}
+	r.resetRoundLocked(-1)
+}
+
+// debugSetScore forces the current set's score, so gameover and overtime
+// can be reached by hand. Like debugResetRound it is only for
+// DEBUG_ENDPOINTS.
+func (r *room) debugSetScore(score [2]int) error {
+	for _, s := range score {
+		if s < 0 || s > 999 {
+			return errDebugScore
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.score = score
+	return nil
+}
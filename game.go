@@ -1,9 +1,17 @@
 package main
 
 import (
+	"crypto/subtle"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"log"
 	"math"
 	"math/rand/v2"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -11,9 +19,8 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+// Default paddle and ball tuning; see roomConfig.
 const (
-	worldW         = 800
-	worldH         = 600
 	paddleW        = 12
 	paddleH        = 90
 	ballRadius     = 8
@@ -21,48 +28,419 @@ const (
 	paddleSpeedPxS = 420
 	ballBaseSpeed  = 360
 	maxBallSpeed   = 850
-	tickRate       = 60
+	// defaultSpeedRamp is how much faster the ball leaves each paddle hit.
+	defaultSpeedRamp = 1.04
+	// defaultServeAngle is the steepest a serve leaves the center, in
+	// radians from the horizontal.
+	defaultServeAngle = 0.4
+
+	// Practice bot tuning: slower than a human paddle and re-aims only a few
+	// times a second so it can be beaten.
+	botSpeedPxS  = 300
+	botReactSecs = 0.15
+)
+
+// serveMode selects how the serve direction is picked at each round reset.
+type serveMode int
+
+const (
+	serveLoser     serveMode = iota // toward whoever conceded the last point
+	serveRandom                     // independent coin flip every serve
+	serveBalanced                   // history-aware, avoids long streaks
+	serveAlternate                  // changes direction every alternateEvery points
+)
+
+// maxServeRun is the longest streak of same-direction serves allowed in
+// balanced mode.
+const maxServeRun = 2
+
+// alternateEvery is how many points are played between serve changes in
+// alternate mode, as in table tennis.
+const alternateEvery = 2
+
+func parseServeMode(s string) (serveMode, bool) {
+	switch s {
+	case "loser":
+		return serveLoser, true
+	case "random":
+		return serveRandom, true
+	case "balanced":
+		return serveBalanced, true
+	case "alternate":
+		return serveAlternate, true
+	}
+	return serveLoser, false
+}
+
+// phase is where a room is in its match lifecycle.
+type phase string
+
+const (
+	phaseWaiting   phase = "waiting"   // seated players haven't all readied up
+	phaseCountdown phase = "countdown" // both ready, ball held until countdownEnd
+	phasePlaying   phase = "playing"
+	phaseFinished  phase = "finished"
+	phasePaused    phase = "paused" // mid-match, waiting out a stalled connection
 )
 
+// countdownDuration is the 3-2-1 before the first serve.
+const countdownDuration = 3 * time.Second
+
+// setBreakDuration is the countdown between sets of a best-of-N match.
+const setBreakDuration = 5 * time.Second
+
 type client struct {
-	id   string
-	name string
-	conn *websocket.Conn
-	send chan []byte
+	id string
+	// name and color are set by c's own goroutine while rooms read them
+	// for every snapshot, so both are guarded by seatMu.
+	name  string
+	color string // paddle color from paddleColors, empty for the default
+	// willing is set for spectators who'll take a seat when both players
+	// have left.
+	willing atomic.Bool
+	userID  string // stable id from a verified token, empty if anonymous
+	token   string // resume token handed out in hello
+	ip      string // counted in hub.conns while connected
+	version int    // message protocol version from the handshake
+	conn    *websocket.Conn
+	send    chan outFrame
+	sendMu  sync.Mutex // serializes queue against closeSend
+	// sendClosed is set once send is closed; guarded by sendMu.
+	sendClosed bool
+
+	binary atomic.Bool  // state frames use the compact binary encoding
+	rtt    atomic.Int64 // last measured ping round trip, in nanoseconds
 
-	room *room
-	side int // 0 left, 1 right, -1 spectator
+	// room and side are where c sits. They change under hub.mu, or under
+	// the room's mu for a side swap, and always under seatMu as well, so
+	// c's own goroutines can read them with seat.
+	seatMu sync.Mutex
+	room   *room
+	side   int // 0 left, 1 right, -1 spectator
+
+	spectatorSeq int       // join order among the room's spectators
+	queuedAt     time.Time // when c last entered matchmaking
+	// heldFull is set once c has been told it's waiting for a free room;
+	// guarded by hub.mu.
+	heldFull bool
 
 	// input state
 	moveDir atomic.Int32 // -1,0,1
-	mouseY  atomic.Int32 // -1 means unused
+	mouseY  atomic.Int32 // mouseUnused when steering with the keys
+	// lastMove is when c last sent move or mouse input, in UnixNano.
+	lastMove atomic.Int64
+	// inputSeq is the seq of c's latest move or mouse input. It is stored
+	// after the input itself, so whoever loads it first sees that input.
+	inputSeq atomic.Uint32
+
+	// dropSince is when send was first found full with nothing getting
+	// through since, in UnixNano, or 0; dropped counts frames dropped over
+	// the connection's life.
+	dropSince atomic.Int64
+	dropped   atomic.Int64
+
+	// inbound rate limiting; only touched by readPump
+	inTokens  float64
+	inLast    time.Time
+	lastChat  time.Time // see allowChat
+	lastReact time.Time
+}
+
+// mouseUnused marks a client's mouseY as unset. Real values are clamped to
+// the field, so it can't collide with one.
+const mouseUnused = math.MinInt32
+
+// mouseDeadZone is how far, in px, a mouse-steered paddle may sit from its
+// target before it moves, so cursor jitter doesn't twitch it every tick.
+const mouseDeadZone = 3
+
+// Inbound message budget per client, as a token bucket.
+const (
+	inputRatePerSec = 120
+	inputBurst      = 120
+)
+
+// allowInput reports whether c may send another message at now, spending a
+// token if so.
+func (c *client) allowInput(now time.Time) bool {
+	if c.inLast.IsZero() {
+		c.inTokens = inputBurst
+	} else {
+		c.inTokens = min(inputBurst, c.inTokens+now.Sub(c.inLast).Seconds()*inputRatePerSec)
+	}
+	c.inLast = now
+	if c.inTokens < 1 {
+		return false
+	}
+	c.inTokens--
+	return true
+}
+
+// steer makes m c's latest input.
+func (c *client) steer(m wsInMove) {
+	c.moveDir.Store(int32(max(-1, min(1, m.Dir))))
+	c.mouseY.Store(mouseUnused)
+	c.inputSeq.Store(m.Seq)
+}
+
+// point makes m c's latest input. Off-field pointers pin the paddle to the
+// nearer edge of a field worldH tall.
+func (c *client) point(m wsInMouse, worldH float64) {
+	c.mouseY.Store(int32(clamp(m.Y, 0, worldH)))
+	c.moveDir.Store(0)
+	c.inputSeq.Store(m.Seq)
+}
+
+// outFrame is one queued WebSocket message.
+type outFrame struct {
+	data   []byte
+	binary bool
+}
+
+// trySend queues a text frame without blocking. It reports false if the
+// client's buffer is full and the frame was dropped.
+func (c *client) trySend(payload []byte) bool {
+	return c.queue(outFrame{data: payload})
+}
+
+// trySendBinary is trySend for a binary frame.
+func (c *client) trySendBinary(payload []byte) bool {
+	return c.queue(outFrame{data: payload, binary: true})
+}
+
+// queue is the only place frames go into c.send. sendMu makes it safe
+// against closeSend: broadcasts routinely hold a client pointer for a moment
+// after its connection has gone.
+func (c *client) queue(f outFrame) bool {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if c.sendClosed {
+		return false
+	}
+	select {
+	case c.send <- f:
+		c.dropSince.Store(0)
+		return true
+	default:
+		// Drop if slow; a player that keeps dropping pauses the match, and
+		// the connection will timeout eventually.
+		c.dropSince.CompareAndSwap(0, time.Now().UnixNano())
+		serverMetrics.framesDropped.Add(1)
+		if c.dropped.Add(1) == dropLogThreshold {
+			log.Printf("client %s (%s): %d frames dropped, connection can't keep up", c.id, c.ip, dropLogThreshold)
+		}
+		return false
+	}
+}
+
+// dropLogThreshold is how many frames a client can lose in all before it
+// is logged, once, as too slow: about five seconds of state at 60Hz.
+const dropLogThreshold = 300
+
+// closeSend closes c.send, ending the writePump. Later sends are dropped.
+func (c *client) closeSend() {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if !c.sendClosed {
+		c.sendClosed = true
+		close(c.send)
+	}
+}
+
+// seat returns c's room, nil if it is in none, and its side there. It is
+// safe without hub.mu or the room's lock.
+func (c *client) seat() (*room, int) {
+	c.seatMu.Lock()
+	defer c.seatMu.Unlock()
+	return c.room, c.side
+}
+
+// setSeat moves c to side of r. The caller holds hub.mu, or r.mu when
+// only swapping sides.
+func (c *client) setSeat(r *room, side int) {
+	c.seatMu.Lock()
+	c.room, c.side = r, side
+	c.seatMu.Unlock()
+}
+
+// displayName is the client's chosen name, or its id if it hasn't set one.
+func (c *client) displayName() string {
+	c.seatMu.Lock()
+	defer c.seatMu.Unlock()
+	if c.name != "" {
+		return c.name
+	}
+	return c.id
 }
 
 type room struct {
-	id string
-	mu sync.Mutex
+	id    string
+	shard int // the game loop shard that steps it, fixed at creation
+	// clock is the room's time source: time.Now, or a simulation's virtual
+	// clock.
+	clock func() time.Time
+	code  string // join code for private rooms, empty for matchmade ones
+	mu    sync.Mutex
+	cfg   config
+	// rules is the paddle and ball tuning, fixed when the room is made.
+	rules roomConfig
+
+	results ResultStore // may be nil
+	ratings *ratingBook // may be nil
+
+	players      [2]*client
+	spectators   map[string]*client
+	spectatorSeq int // last join order handed to a spectator
+	// nextUp is the spectators queued to play, front first; see
+	// queueToPlay.
+	nextUp []*client
 
-	players    [2]*client
-	spectators map[string]*client
+	// bot marks sides driven by the server-side practice AI.
+	bot [2]bool
+	// bench marks a bot-vs-bot load test room; see createBenchRoom.
+	bench      bool
+	botTargetY [2]float64
+	botThink   [2]float64 // seconds until the bot re-aims
 
-	paddleY [2]float64
-	score   [2]int
+	// away marks players who dropped and may still resume; the match is
+	// paused from pausedAt until they return or graceTimer frees the slot.
+	away       [2]bool
+	graceTimer [2]*time.Timer
+	pausedAt   time.Time
+	// host is the player who made a private room, or first joined a
+	// reserved one; only they may kick spectators.
+	host *client
+	// passwordHash, if set, must be matched by anyone joining by id or
+	// code; see passwordOKLocked.
+	passwordHash []byte
+	// reservedUntil is set for rooms made over POST /matches, which are
+	// held open with nobody in them until then.
+	reservedUntil time.Time
+	// seats, in a tournament room, holds the token of the entrant each
+	// side is kept for; onFinish reports the match's winning side, or -1,
+	// to the bracket, including when the room closes undecided. onFinish
+	// runs on its own goroutine, without r.mu.
+	seats    [2]string
+	onFinish func(winner int)
+	// orphanedSince is when the last player left spectators behind.
+	orphanedSince time.Time
+	// stalledSince is when a player's full send buffer paused the match.
+	stalledSince time.Time
+	// activeSince is when play last started or resumed; a player's AFK time
+	// counts from it at the earliest.
+	activeSince time.Time
+	afkWarned   [2]bool
+	// ackSeq is each side's last input seq that step has applied.
+	ackSeq [2]uint32
 
-	ballX  float64
-	ballY  float64
-	ballVX float64
-	ballVY float64
+	paddleY   [2]float64
+	paddleLen [2]float64 // current paddle heights; rules.paddleHeight unless a power-up or Shrink says otherwise
+	rallyHits int        // paddle hits since the last point
+	// longestRally is the most rallyHits reached this match.
+	longestRally int
+	// recent is the room's scoreboard of finished matches; see
+	// recordRecentLocked.
+	recent  []recentMatch
+	score   [2]int // points in the current set
+	setsWon [2]int
 
-	startTime time.Time
-	endTime   time.Time
-	lastTick  time.Time
+	// seed starts rng for the current match; it is recorded with the result
+	// so the match can be replayed from it and the players' inputs.
+	seed uint64
+	rng  *rand.Rand
+	// tick counts steps of play this match; rec, if recording, logs inputs
+	// against it.
+	tick int
+	rec  *recorder
+	// timeline samples the score once per timelineStride seconds of play
+	// for the match result.
+	timeline       []scoreSample
+	timelineStride int
+
+	// balls holds cfg.balls balls; the first is the one reported in the
+	// single-ball state fields.
+	balls []ball
+
+	// Power-ups on the field and active paddle effects, when cfg.powerups
+	// is on.
+	powerups    []powerup
+	effects     []paddleEffect
+	nextPowerup int // tick of the next spawn, 0 before the first is due
+
+	serveMode  serveMode
+	serveCount [2]int  // serves sent toward the left (0) and right (1)
+	points     int     // points played this match, for alternate mode
+	serveRun   int     // consecutive serves in lastServe's direction
+	lastServe  float64 // -1 left, 1 right, 0 none yet
+
+	createdAt  time.Time
+	startTime  time.Time
+	endTime    time.Time
+	finishTime time.Time // when the match ended; zero until then
+	lastTick   time.Time
+	// setupAt is when the current match was set up: the room's creation,
+	// a restart, or the first serve, whichever came last. maxRoomAge
+	// counts from here, so rematches and series aren't cut short.
+	setupAt time.Time
+	// lastInput is when a player last did something, in UnixNano. It is
+	// written from readPump without the room lock.
+	lastInput atomic.Int64
+
+	// closed is set, under mu, once the room is removed from the hub.
+	closed bool
+
+	// phase only moves to phaseFinished once, so gameover fires exactly once.
+	phase        phase
+	ready        [2]bool
+	countdownEnd time.Time
+	overtime     bool // sudden death after a tied clock; next point wins
+	// serveTicks holds the balls on the center line for this many more
+	// ticks after a round resets, so players can see which way the serve
+	// will go. It counts ticks rather than time to keep replays exact.
+	serveTicks int
+	// rematch records which sides have asked to play again after gameover.
+	rematch [2]bool
+	// outbox holds messages queued under mu; runLoop broadcasts them after
+	// the room lock is released.
+	outbox []wsOut
+	// rehello holds players whose side changed under mu; runLoop sends each
+	// a fresh hello.
+	rehello []*client
+	// kick holds players to disconnect for being AFK.
+	kick []*client
+}
+
+// ball is one ball in play.
+type ball struct {
+	x, y   float64
+	vx, vy float64
+	// lastHit is the side that last returned the ball this rally, or -1.
+	lastHit int
 }
 
 type hub struct {
-	mu      sync.Mutex
-	waitQ   []*client
-	nextRID int
-	rooms   map[string]*room
+	cfg     config
+	results ResultStore
+	auth    Verifier // nil when everyone plays anonymously
+	ratings *ratingBook
+	conns   *connLimiter
+	// tournaments is locked before mu; see tournamentBook.
+	tournaments *tournamentBook
+	mu          sync.Mutex
+	waitQ       []*client
+	nextRID     int
+	rooms       map[string]*room
+	codes       map[string]*room // private room join codes
+	// shards holds each game loop shard's rooms, kept alongside rooms so
+	// a loop doesn't scan every room on every tick.
+	shards []map[*room]struct{}
+
+	resumable map[string]*client   // suspended players by resume token
+	watching  map[string]watchMark // dropped spectators by resume token
+	clients   map[*client]struct{} // every open connection
+
+	// stop is closed to end the game loops.
+	stop chan struct{}
 }
 
 type wsIn struct {
@@ -73,14 +451,42 @@ type wsIn struct {
 type wsInJoin struct {
 	RoomID string `json:"roomId"`
 	Name   string `json:"name"`
+	Color  string `json:"color,omitempty"`  // one of paddleColors
+	Play   bool   `json:"play,omitempty"`   // willing to be seated from the stands
+	Binary bool   `json:"binary,omitempty"` // opt in to binary state frames
+	Side   *int   `json:"side,omitempty"`   // preferred side; see preferredSide
+	// Password is required to join a room created with one.
+	Password string `json:"password,omitempty"`
+	// Seat is an entrant's token, required to play in a tournament room.
+	Seat string `json:"seat,omitempty"`
+}
+
+var errBadSide = errors.New("side must be 0 or 1")
+
+// preferredSide checks a requested side. A nil request means no preference,
+// returned as -1.
+func preferredSide(side *int) (int, error) {
+	if side == nil {
+		return -1, nil
+	}
+	if *side != 0 && *side != 1 {
+		return -1, errBadSide
+	}
+	return *side, nil
+}
+
+type wsInKick struct {
+	ClientID string `json:"clientId"`
 }
 
 type wsInMove struct {
-	Dir int `json:"dir"` // -1 up, 1 down, 0 stop
+	Dir int    `json:"dir"`           // -1 up, 1 down, 0 stop
+	Seq uint32 `json:"seq,omitempty"` // client's input counter, echoed in state
 }
 
 type wsInMouse struct {
-	Y float64 `json:"y"` // canvas-relative y
+	Y   float64 `json:"y"` // canvas-relative y
+	Seq uint32  `json:"seq,omitempty"`
 }
 
 type wsOut struct {
@@ -89,281 +495,1854 @@ type wsOut struct {
 }
 
 type wsOutHello struct {
-	ClientID string `json:"clientId"`
-	RoomID   string `json:"roomId"`
-	Side     int    `json:"side"` // 0 left, 1 right, -1 spectator
-	W        int    `json:"w"`
-	H        int    `json:"h"`
+	ClientID string      `json:"clientId"`
+	UserID   string      `json:"userId,omitempty"`
+	Rating   int         `json:"rating,omitempty"` // signed-in players only
+	Rules    *roomConfig `json:"rules,omitempty"`
+	Name     string      `json:"name,omitempty"`
+	Color    string      `json:"color"`
+	Colors   [2]string   `json:"colors"` // each side's paddle color, "" if empty
+	// Players names each side's player at hello, empty for a free slot;
+	// "players" messages carry renames and side swaps.
+	Players [2]string `json:"players"`
+	// Recent lists the room's last few finished matches, oldest first;
+	// "recent" messages carry the new list after each gameover.
+	Recent []recentMatch `json:"recent,omitempty"`
+	// NextUp is the room's queue of spectators waiting to play, front
+	// first; "next_up" messages carry later changes.
+	NextUp []nextUpEntry `json:"nextUp,omitempty"`
+	// Spectators lists the room's spectators at hello; "spectators" events
+	// carry later changes.
+	Spectators []string `json:"spectators,omitempty"`
+	RoomID     string   `json:"roomId"`
+	Code       string   `json:"code,omitempty"`
+	Token      string   `json:"resumeToken,omitempty"`
+	Side       int      `json:"side"` // 0 left, 1 right, -1 spectator
+	W          int      `json:"w"`
+	H          int      `json:"h"`
+
+	// Server-wide settings, so clients needn't hardcode them.
+	Margin       int  `json:"margin"` // gap between each paddle and its goal line
+	TickRate     int  `json:"tickRate"`
+	BroadcastHz  int  `json:"broadcastHz"`  // state frames per second
+	MatchSeconds int  `json:"matchSeconds"` // per set
+	Sets         int  `json:"sets"`
+	Balls        int  `json:"balls"`
+	Powerups     bool `json:"powerups"`
 }
 
 type wsOutState struct {
 	PaddleY [2]float64 `json:"paddleY"`
+	PaddleH [2]float64 `json:"paddleH"`
 	BallX   float64    `json:"ballX"`
 	BallY   float64    `json:"ballY"`
+	BallVX  float64    `json:"ballVX"` // px/s, for client-side extrapolation
+	BallVY  float64    `json:"ballVY"`
 	Score   [2]int     `json:"score"`
+	Sets    [2]int     `json:"sets"`
+	Colors  [2]string  `json:"colors"`
+	// BallSpeed is the first ball's speed in px/s, for a speedometer
+	// against rules.maxBallSpeed. While a serve is held it is the speed
+	// the ball will leave at.
+	BallSpeed float64 `json:"ballSpeed"`
+	// AckSeq is each side's last input seq applied to its paddle, for
+	// client-side prediction.
+	// Sent to v2 clients only.
+	AckSeq  *[2]uint32 `json:"ackSeq,omitempty"`
 	Running bool       `json:"running"`
 
-	SecondsLeft int      `json:"secondsLeft"`
-	Spectators  []string `json:"spectators"`
+	Phase     string  `json:"phase"`
+	Ready     [2]bool `json:"ready"`
+	Countdown int     `json:"countdown"` // whole seconds left in the countdown phase
+	Overtime  bool    `json:"overtime"`
+	Latency   [2]int  `json:"latency"` // each player's last ping round trip in ms
+
+	SecondsLeft    int       `json:"secondsLeft"`
+	ElapsedSeconds int       `json:"elapsedSeconds"` // since the first serve
+	Rally          int       `json:"rally"`          // paddle hits this rally
+	LongestRally   int       `json:"longestRally"`   // this match
+	Powerups       []powerup `json:"powerups,omitempty"`
+	// Serving is set while the balls are held on the center line after a
+	// round resets; ServeDir is then the way they will go, -1 left or 1
+	// right, and the ball velocities are reported as zero.
+	Serving  bool `json:"serving"`
+	ServeDir int  `json:"serveDir"`
+	// Balls lists every ball when there is more than one; the first is
+	// also in the single-ball fields above.
+	Balls []wsOutBall `json:"balls,omitempty"`
+
+	// ServerTime is milliseconds on the server's monotonic clock, shared by
+	// every room in a shard's tick.
+	ServerTime int64 `json:"serverTime"`
 }
 
-func newHub() *hub {
-	return &hub{rooms: make(map[string]*room)}
+type wsOutBall struct {
+	X  float64 `json:"x"`
+	Y  float64 `json:"y"`
+	VX float64 `json:"vx"`
+	VY float64 `json:"vy"`
 }
 
-func (h *hub) joinByRoomID(c *client, roomID string) bool {
-	h.mu.Lock()
-	r := h.rooms[roomID]
-	h.mu.Unlock()
-	if r == nil {
-		return false
+// extraBalls lists balls for wsOutState.Balls, or nil in single-ball play.
+func extraBalls(balls []ball) []wsOutBall {
+	if len(balls) < 2 {
+		return nil
 	}
-
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	if r.spectators == nil {
-		r.spectators = make(map[string]*client)
+	out := make([]wsOutBall, len(balls))
+	for i, b := range balls {
+		out[i] = wsOutBall{X: b.x, Y: b.y, VX: b.vx, VY: b.vy}
 	}
-	c.room = r
-	c.side = -1
-	r.spectators[c.id] = c
-	return true
+	return out
 }
 
-func (h *hub) assignToRoom(c *client) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
+// roomInfo is the public summary of a room served by GET /rooms.
+type roomInfo struct {
+	ID          string `json:"id"`
+	Full        bool   `json:"full"`
+	Score       [2]int `json:"score"`
+	SecondsLeft int    `json:"secondsLeft"`
+	Spectators  int    `json:"spectators"`
+}
+
+// wsOutEvent announces a change in room membership.
+type wsOutEvent struct {
+	Kind     string `json:"kind"` // player_joined, player_left, spectator_joined, spectator_left, spectator_kicked
+	ClientID string `json:"clientId"`
+	Name     string `json:"name"`
+	Color    string `json:"color"`
+	Side     int    `json:"side"`
+}
 
-	// If someone is waiting, pair them.
-	if len(h.waitQ) > 0 {
-		other := h.waitQ[0]
-		h.waitQ = h.waitQ[1:]
+type wsOutRematch struct {
+	Ready [2]bool `json:"ready"`
+}
 
-		rid := h.nextRID
-		h.nextRID++
-		r := newRoom(rid)
-		h.rooms[r.id] = r
+type wsOutRoomClosed struct {
+	Reason string `json:"reason"`
+}
 
-		r.players[0] = other
-		r.players[1] = c
-		other.room, other.side = r, 0
-		c.room, c.side = r, 1
-		return
+// wsOutScored announces a point as it is scored, ahead of any set_over or
+// gameover it causes.
+type wsOutScored struct {
+	Side  int    `json:"side"`  // who scored
+	Score [2]int `json:"score"` // in the current set, counting this point
+	Rally int    `json:"rally"` // paddle hits in the rally it ended
+}
+
+type wsOutSetOver struct {
+	Score  [2]int `json:"score"`
+	Winner int    `json:"winner"`
+	Sets   [2]int `json:"sets"`
+}
+
+type wsOutGameOver struct {
+	Score     [2]int `json:"score"` // of the final set
+	Sets      [2]int `json:"sets"`
+	Winner    int    `json:"winner"` // 0 left, 1 right, -1 draw
+	Seed      uint64 `json:"seed"`
+	Seconds   int    `json:"seconds"`
+	EndReason string `json:"endReason"`
+	// LongestRally is the most paddle hits in one rally this match.
+	LongestRally int `json:"longestRally"`
+}
+
+func newHub(cfg config, results ResultStore) *hub {
+	return &hub{
+		cfg:         cfg,
+		results:     results,
+		auth:        newVerifier(cfg),
+		ratings:     newRatingBook(),
+		conns:       newConnLimiter(cfg.maxConnsPerIP),
+		tournaments: newTournamentBook(),
+		rooms:       make(map[string]*room),
+		codes:       make(map[string]*room),
+		shards:      newShardSets(cfg.shards),
+		resumable:   make(map[string]*client),
+		watching:    make(map[string]watchMark),
+		clients:     make(map[*client]struct{}),
+		stop:        make(chan struct{}),
 	}
+}
 
-	// Otherwise wait.
-	h.waitQ = append(h.waitQ, c)
-	c.side = -1
+// register tracks c as an open connection.
+func (h *hub) register(c *client) {
+	h.mu.Lock()
+	h.clients[c] = struct{}{}
+	h.mu.Unlock()
 }
 
-func (h *hub) removeClient(c *client) {
+// unregister forgets c once its connection has closed.
+func (h *hub) unregister(c *client) {
 	h.mu.Lock()
-	// Remove from waiting queue.
+	delete(h.clients, c)
+	h.mu.Unlock()
+}
+
+// allClients returns every open connection.
+func (h *hub) allClients() []*client {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make([]*client, 0, len(h.clients))
+	for c := range h.clients {
+		out = append(out, c)
+	}
+	return out
+}
+
+// roomCodeLen is the length of generated private room codes.
+const roomCodeLen = 5
+
+// newCodeLocked returns an unused private room code. h.mu must be held.
+func (h *hub) newCodeLocked() string {
+	for {
+		buf := make([]byte, roomCodeLen)
+		for i := range buf {
+			buf[i] = byte('A' + rand.IntN(26))
+		}
+		if code := string(buf); h.codes[code] == nil {
+			return code
+		}
+	}
+}
+
+// dequeueLocked removes c from the matchmaking queue, if present. h.mu must
+// be held.
+func (h *hub) dequeueLocked(c *client) bool {
 	for i := range h.waitQ {
 		if h.waitQ[i] == c {
 			h.waitQ = append(h.waitQ[:i], h.waitQ[i+1:]...)
-			h.mu.Unlock()
-			return
+			return true
 		}
 	}
-	if c.room == nil {
-		h.mu.Unlock()
-		return
-	}
-	r := c.room
-	h.mu.Unlock()
+	return false
+}
 
-	r.mu.Lock()
-	for side := 0; side < 2; side++ {
-		if r.players[side] == c {
-			r.players[side] = nil
-		}
+// createRoom makes a private room with a fresh join code and the given
+// tuning, and seats c on side, or the left side if side is -1. A non-empty
+// password is then needed to join. At the room limit c stays in matchmaking
+// and createRoom returns errServerFull.
+func (h *hub) createRoom(c *client, rc roomConfig, side int, password string) (*room, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.fullLocked() {
+		c.heldFull = true // the caller tells it
+		return nil, errServerFull
 	}
-	delete(r.spectators, c.id)
-	empty := r.players[0] == nil && r.players[1] == nil && len(r.spectators) == 0
-	r.mu.Unlock()
+	h.dequeueLocked(c)
 
-	if empty {
-		h.mu.Lock()
-		delete(h.rooms, r.id)
-		h.mu.Unlock()
+	r := h.newPrivateRoomLocked(rc)
+	r.passwordHash = hashRoomPassword(r.id, password)
+	side = max(side, 0)
+	r.players[side] = c
+	r.host = c
+	c.setSeat(r, side)
+	return r, nil
+}
+
+// newPrivateRoomLocked allocates a room with a fresh join code and the given
+// tuning. h.mu must be held.
+func (h *hub) newPrivateRoomLocked(rc roomConfig) *room {
+	r := h.newRoomLocked()
+	r.code = h.newCodeLocked()
+	h.codes[r.code] = r
+	r.rules = rc
+	r.clearPowerupsLocked()
+	r.centerLocked()
+	return r
+}
+
+// createPracticeRoom seats c on the left side against the practice bot. Like
+// createRoom it fails with errServerFull at the room limit.
+func (h *hub) createPracticeRoom(c *client) (*room, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.fullLocked() {
+		c.heldFull = true // the caller tells it
+		return nil, errServerFull
 	}
+	h.dequeueLocked(c)
+
+	r := h.newRoomLocked()
+	r.players[0] = c
+	r.bot[1] = true
+	c.setSeat(r, 0)
+	return r, nil
 }
 
-const matchDuration = 5 * time.Minute
+// shardRooms returns the rooms stepped by the given game loop shard. A room
+// stays in the shard its id hashes to for its whole life.
+func (h *hub) shardRooms(shard int) []*room {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	rooms := make([]*room, 0, len(h.shards[shard]))
+	for r := range h.shards[shard] {
+		rooms = append(rooms, r)
+	}
+	return rooms
+}
 
-func newRoom(n int) *room {
-	r := &room{
-		id:         "room-" + itoa(n),
-		spectators: make(map[string]*client),
+func newShardSets(shards int) []map[*room]struct{} {
+	sets := make([]map[*room]struct{}, shards)
+	for i := range sets {
+		sets[i] = make(map[*room]struct{})
 	}
-	r.resetRoundLocked()
+	return sets
+}
+
+func shardOf(roomID string, shards int) int {
+	f := fnv.New32a()
+	f.Write([]byte(roomID))
+	return int(f.Sum32() % uint32(shards))
+}
+
+// fullLocked reports whether the hub is at its room limit. h.mu must be held.
+func (h *hub) fullLocked() bool {
+	return len(h.rooms) >= h.cfg.maxRooms
+}
+
+// newRoomLocked allocates and registers a new room. h.mu must be held.
+func (h *hub) newRoomLocked() *room {
+	rid := h.nextRID
+	h.nextRID++
+	r := newRoom(rid, h.cfg)
+	r.shard = shardOf(r.id, h.cfg.shards)
+	r.results = h.results
+	r.ratings = h.ratings
+	h.rooms[r.id] = r
+	h.shards[r.shard][r] = struct{}{}
+	serverMetrics.roomsCreated.Add(1)
 	return r
 }
 
-func (r *room) resetRoundLocked() {
-	r.paddleY[0] = (worldH - paddleH) / 2
-	r.paddleY[1] = (worldH - paddleH) / 2
+var (
+	errRoomNotFound = errors.New("room not found")
+	errRoomFull     = errors.New("room full")
+	errNoLiveRooms  = errors.New("no matches in play")
+	errServerFull   = errors.New("server full")
+	errNotHost      = errors.New("only the room's host can do that")
+	errNoSpectator  = errors.New("no such spectator")
+)
 
-	r.ballX = worldW / 2
-	r.ballY = worldH / 2
+// joinByRoomID attaches c to the room with the given id or join code. A
+// private room is only found by its code, since room ids are easy to guess.
+// c takes an open player slot if there is one, trying prefer first unless
+// it is -1; otherwise it spectates, up to the room's spectator limit.
+// Either way password must match the room's, and a tournament room seats
+// only the entrant whose token matches seat. A client already in another
+// room leaves it once the new one has taken them, so it is never listed in
+// two.
+func (h *hub) joinByRoomID(c *client, roomID string, prefer int, password, seat string) error {
+	var promoted []*client
+	defer func() {
+		for _, p := range promoted {
+			payload, _ := json.Marshal(helloFor(p))
+			p.trySend(payload)
+		}
+	}()
+	h.mu.Lock()
+	defer h.mu.Unlock()
 
-	angle := (rand.Float64()*0.8 - 0.4) // -0.4..0.4 radians-ish
-	dir := 1.0
-	if rand.IntN(2) == 0 {
-		dir = -1
+	r := h.rooms[roomID]
+	if r == nil || r.code != "" {
+		r = h.codes[strings.ToUpper(roomID)]
 	}
-	r.ballVX = dir * ballBaseSpeed
-	r.ballVY = math.Tan(angle) * ballBaseSpeed
-
-	now := time.Now()
-	r.lastTick = now
-	if r.startTime.IsZero() {
-		r.startTime = now
-		r.endTime = now.Add(matchDuration)
+	if r == nil {
+		return errRoomNotFound
 	}
+	old := c.room
+	if old == r {
+		return nil
+	}
+	if err := h.attachLocked(r, c, prefer, password, seat); err != nil {
+		return err
+	}
+	if old != nil {
+		promoted = h.detachLocked(old, c)
+	}
+	return nil
 }
 
-func (r *room) step(dt float64) {
+// attachLocked is joinByRoomID for a room c isn't in yet. It points c.room
+// at r on success. h.mu must be held and r.mu must not.
+func (h *hub) attachLocked(r *room, c *client, prefer int, password, seat string) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-
-	running := r.players[0] != nil && r.players[1] != nil
-	if !running {
-		return
-	}
-	if !r.endTime.IsZero() && time.Now().After(r.endTime) {
-		return
+	if !r.passwordOKLocked(password) {
+		return errBadPassword
 	}
-
-	// Apply paddle movement.
-	for side := 0; side < 2; side++ {
-		p := r.players[side]
-		if p == nil {
+	first := max(prefer, 0)
+	for _, side := range [2]int{first, 1 - first} {
+		if r.filledLocked(side) {
 			continue
 		}
-		if y := p.mouseY.Load(); y >= 0 {
-			r.paddleY[side] = clamp(float64(y)-paddleH/2, 0, worldH-paddleH)
-		} else {
-			dir := float64(p.moveDir.Load())
-			r.paddleY[side] = clamp(r.paddleY[side]+dir*paddleSpeedPxS*dt, 0, worldH-paddleH)
+		// Tournament seats are kept for their entrants.
+		if r.seats[side] != "" && subtle.ConstantTimeCompare([]byte(seat), []byte(r.seats[side])) != 1 {
+			continue
+		}
+		h.dequeueLocked(c)
+		r.players[side] = c
+		c.setSeat(r, side)
+		// The first player into a reserved room hosts it.
+		if r.code != "" && r.host == nil {
+			r.host = c
 		}
+		r.touch()
+		r.eventLocked("player_joined", c)
+		return nil
 	}
 
-	// Move ball.
-	r.ballX += r.ballVX * dt
-	r.ballY += r.ballVY * dt
-
-	// Wall bounce (top/bottom).
-	if r.ballY-ballRadius < 0 {
-		r.ballY = ballRadius
-		r.ballVY *= -1
-	}
-	if r.ballY+ballRadius > worldH {
-		r.ballY = worldH - ballRadius
-		r.ballVY *= -1
+	if len(r.spectators) >= r.cfg.maxSpectators {
+		return errRoomFull
 	}
+	h.addSpectatorLocked(r, c)
+	return nil
+}
 
-	// Paddle collisions.
-	leftFaceX := float64(paddleMargin + paddleW)
-	rightFaceX := float64(worldW - paddleMargin - paddleW)
-	leftPaddleX := float64(paddleMargin)
-	rightPaddleX := float64(worldW - paddleMargin - paddleW)
+// kickSpectator removes the spectator with id targetID from host's room and
+// returns them; the caller tells them and hangs up. Only a private room's
+// host may kick.
+func (h *hub) kickSpectator(host *client, targetID string) (*client, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 
-	// Left paddle overlap.
-	if r.ballVX < 0 && r.ballX-ballRadius <= leftFaceX {
-		py := r.paddleY[0]
-		if r.ballY >= py && r.ballY <= py+paddleH && r.ballX+ballRadius >= leftPaddleX {
-			r.ballX = leftFaceX + ballRadius
-			r.bounceOffPaddle(0)
-		}
-	}
-	// Right paddle overlap.
-	if r.ballVX > 0 && r.ballX+ballRadius >= rightFaceX {
-		py := r.paddleY[1]
-		if r.ballY >= py && r.ballY <= py+paddleH && r.ballX-ballRadius <= rightPaddleX+paddleW {
-			r.ballX = rightFaceX - ballRadius
-			r.bounceOffPaddle(1)
-		}
+	r := host.room
+	if r == nil {
+		return nil, errNotHost
 	}
-
-	// Scoring.
-	if r.ballX+ballRadius < 0 {
-		r.score[1]++
-		r.resetRoundLocked()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.host != host || host.side < 0 {
+		return nil, errNotHost
 	}
-	if r.ballX-ballRadius > worldW {
-		r.score[0]++
-		r.resetRoundLocked()
+	target := r.spectators[targetID]
+	if target == nil {
+		return nil, errNoSpectator
 	}
+	delete(r.spectators, targetID)
+	r.unqueueLocked(target)
+	r.eventLocked("spectator_kicked", target)
+	target.setSeat(nil, -1)
+	return target, nil
 }
 
-func (r *room) bounceOffPaddle(side int) {
-	// Add spin based on hit position.
-	p := r.paddleY[side]
-	rel := (r.ballY - (p + paddleH/2)) / (paddleH / 2) // -1..1
-	rel = clamp(rel, -1, 1)
+// addSpectatorLocked seats c as a spectator of r. h.mu and r.mu must be held.
+func (h *hub) addSpectatorLocked(r *room, c *client) {
+	h.dequeueLocked(c)
+	if r.spectators == nil {
+		r.spectators = make(map[string]*client)
+	}
+	c.setSeat(r, -1)
+	r.spectatorSeq++
+	c.spectatorSeq = r.spectatorSeq
+	r.spectators[c.id] = c
+	r.eventLocked("spectator_joined", c)
+}
 
-	speed := math.Hypot(r.ballVX, r.ballVY)
-	speed = clamp(speed*1.04, ballBaseSpeed, maxBallSpeed)
+// spectateLive seats c as a spectator of the most-watched public match in
+// play, picking at random among equally watched ones. c leaves matchmaking
+// either way, since it asked only to watch.
+func (h *hub) spectateLive(c *client) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 
-	angle := rel * 0.9 // max ~50 degrees
+	h.dequeueLocked(c)
 
-	// Flip direction and apply spin while preserving speed.
-	dir := 1.0
-	if side == 0 {
-		dir = 1
-	} else {
-		dir = -1
+	var best *room
+	most, ties := -1, 0
+	for _, r := range h.rooms {
+		r.mu.Lock()
+		ok := r.code == "" && !r.bench && r.liveLocked() && r.filledLocked(0) && r.filledLocked(1) &&
+			len(r.spectators) < r.cfg.maxSpectators
+		n := len(r.spectators)
+		r.mu.Unlock()
+		if !ok || n < most {
+			continue
+		}
+		if n > most {
+			most, ties = n, 0
+		}
+		// Reservoir sampling keeps each tied room equally likely.
+		ties++
+		if rand.IntN(ties) == 0 {
+			best = r
+		}
 	}
-	if r.ballVX < 0 {
-		dir = 1
-	} else {
-		dir = -1
+	if best == nil {
+		return errNoLiveRooms
 	}
-	vx := math.Abs(speed * math.Cos(angle))
-	r.ballVX = dir * vx
-	r.ballVY = speed * math.Sin(angle)
+
+	best.mu.Lock()
+	defer best.mu.Unlock()
+	h.addSpectatorLocked(best, c)
+	return nil
+}
+
+// assignToRoom queues c for matchmaking and pairs it straight away if there
+// is a suitable opponent waiting. The caller sends c its hello.
+func (h *hub) assignToRoom(c *client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	c.setSeat(c.room, -1)
+	c.queuedAt = now
+	c.heldFull = false
+	h.waitQ = append(h.waitQ, c)
+	h.matchLocked(now, c)
+}
+
+// matchWaiting retries matchmaking as rating windows widen.
+func (h *hub) matchWaiting(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.matchLocked(now, nil)
 }
 
-func (r *room) snapshot() wsOutState {
+// pairLocked seats a, who waited longer, on the left and b on the right of a
+// new room, and sends each its new hello unless it is skip. Neither can have
+// closed its send channel while still queued, since removeClient dequeues
+// under h.mu first.
+func (h *hub) pairLocked(a, b, skip *client) {
+	r := h.newRoomLocked()
+
+	r.players[0] = a
+	r.players[1] = b
+	a.setSeat(r, 0)
+	b.setSeat(r, 1)
+	serverMetrics.playersMatched.Add(2)
+
 	r.mu.Lock()
-	defer r.mu.Unlock()
+	r.eventLocked("player_joined", a)
+	r.eventLocked("player_joined", b)
+	r.mu.Unlock()
 
-	secondsLeft := 0
-	if !r.endTime.IsZero() {
-		secondsLeft = int(time.Until(r.endTime).Seconds())
-		if secondsLeft < 0 {
-			secondsLeft = 0
+	for _, c := range []*client{a, b} {
+		if c == skip {
+			continue
 		}
+		payload, _ := json.Marshal(helloFor(c))
+		c.trySend(payload)
 	}
+}
 
-	spectators := make([]string, 0, len(r.spectators))
-	for _, c := range r.spectators {
-		if c == nil {
-			continue
+func (h *hub) removeClient(c *client) {
+	serverMetrics.clientsRemoved.Add(1)
+
+	h.mu.Lock()
+	// Remove from waiting queue.
+	if h.dequeueLocked(c) {
+		h.mu.Unlock()
+		return
+	}
+	h.mu.Unlock()
+
+	h.leaveRoom(c)
+}
+
+// leaveRoom takes c out of its room, freeing its player slot or spectator
+// seat, and closes the room if nobody is left. c's connection is untouched.
+// h.mu is held throughout, so the room can't gain a member between being
+// found empty and being removed.
+func (h *hub) leaveRoom(c *client) {
+	h.mu.Lock()
+	r := c.room
+	if r == nil {
+		h.mu.Unlock()
+		return
+	}
+	promoted := h.detachLocked(r, c)
+	c.setSeat(nil, -1)
+	h.mu.Unlock()
+
+	for _, p := range promoted {
+		payload, _ := json.Marshal(helloFor(p))
+		p.trySend(payload)
+	}
+}
+
+// detachLocked takes c out of r's player slots and spectators, closing r if
+// that empties it. It leaves c.room alone; the caller points it elsewhere.
+// It returns any spectators promoted into a freed slot, who need a fresh
+// hello once h.mu is released. h.mu must be held and r.mu must not.
+func (h *hub) detachLocked(r *room, c *client) []*client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for side := 0; side < 2; side++ {
+		if r.players[side] == c {
+			r.eventLocked("player_left", c)
+			// Walking out of a live match hands it to the opponent. This
+			// runs before the slot is cleared so the result names both.
+			if r.liveLocked() && r.filledLocked(1-side) {
+				r.finishAsLocked("forfeit", 1-side)
+			}
+			r.players[side] = nil
+			// A pending rematch or countdown needs both players.
+			r.rematch = [2]bool{}
+			r.ready[side] = false
+			if r.phase == phaseCountdown {
+				r.phase = phaseWaiting
+			}
+			r.unpauseLocked()
+			r.away[side] = false
+			r.graceTimer[side] = nil
+			r.resumeClockLocked()
+		}
+	}
+	if r.spectators[c.id] == c {
+		r.eventLocked("spectator_left", c)
+		delete(r.spectators, c.id)
+		r.unqueueLocked(c)
+	}
+	promoted := r.promoteSpectatorsLocked()
+	// A reserved room stays open for its players until the reservation
+	// runs out; idle closes it after that.
+	if r.emptyLocked() && r.reservedUntil.IsZero() {
+		h.removeRoomLocked(r)
+	}
+	return promoted
+}
+
+// removeRoomLocked unlists r and marks it closed, so a game loop that
+// already picked it up this tick skips it. h.mu and r.mu must be held.
+func (h *hub) removeRoomLocked(r *room) {
+	delete(h.rooms, r.id)
+	delete(h.shards[r.shard], r)
+	if r.code != "" {
+		delete(h.codes, r.code)
+	}
+	r.closed = true
+}
+
+// isClosed reports whether r has been removed from the hub.
+func (r *room) isClosed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed
+}
+
+// closeRoom shuts r down, telling everyone still in it why and then closing
+// their connections. Players held for resume are dropped.
+func (h *hub) closeRoom(r *room, reason string) {
+	h.mu.Lock()
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		h.mu.Unlock()
+		return
+	}
+	h.removeRoomLocked(r)
+	// A tournament match can't be left pointing at a closed room. It goes
+	// to the only entrant who showed up; with neither or both there, to
+	// the first seat, as a draw does.
+	if r.onFinish != nil && r.phase != phaseFinished {
+		winner := -1
+		if r.filledLocked(0) != r.filledLocked(1) {
+			winner = 0
+			if r.filledLocked(1) {
+				winner = 1
+			}
+		}
+		go r.onFinish(winner)
+	}
+	var members []*client
+	for side := 0; side < 2; side++ {
+		p := r.players[side]
+		if p == nil {
+			continue
+		}
+		if r.away[side] {
+			delete(h.resumable, p.token)
+			if t := r.graceTimer[side]; t != nil {
+				t.Stop()
+			}
+		} else {
+			members = append(members, p)
+		}
+		r.players[side] = nil
+	}
+	for _, s := range r.spectators {
+		members = append(members, s)
+	}
+	r.spectators = make(map[string]*client)
+	r.nextUp = nil
+	r.away = [2]bool{}
+	r.graceTimer = [2]*time.Timer{}
+	for _, c := range members {
+		// Detached first, so the disconnect that follows has nothing to leave.
+		c.setSeat(nil, -1)
+	}
+	r.mu.Unlock()
+	h.mu.Unlock()
+
+	payload, _ := json.Marshal(wsOut{Type: "room_closed", Data: wsOutRoomClosed{Reason: reason}})
+	for _, c := range members {
+		c.trySend(payload)
+	}
+	// Give the writePumps a moment to flush the notice before hanging up.
+	time.AfterFunc(shutdownFlush, func() {
+		for _, c := range members {
+			closeConn(c, websocket.CloseNormalClosure, "room closed")
+		}
+	})
+}
+
+// promoteSpectatorsLocked fills open player slots from the spectators and
+// returns whoever it moved. The "next up" queue is seated first, in order.
+// After that, with one side free, the longest-watching spectator steps in.
+// With both free, only spectators who asked to play are seated, in the
+// order they arrived; otherwise the room is left to orphaned.
+func (r *room) promoteSpectatorsLocked() []*client {
+	// Tournament seats wait for their entrants instead.
+	if r.seats != ([2]string{}) {
+		return nil
+	}
+	var open []int
+	for side := 0; side < 2; side++ {
+		if !r.filledLocked(side) {
+			open = append(open, side)
+		}
+	}
+	if len(open) == 0 {
+		return nil
+	}
+
+	rest := make([]*client, 0, len(r.spectators))
+	for _, s := range r.spectators {
+		if !slices.Contains(r.nextUp, s) && (len(open) == 1 || s.willing.Load()) {
+			rest = append(rest, s)
+		}
+	}
+	sort.Slice(rest, func(i, j int) bool { return rest[i].spectatorSeq < rest[j].spectatorSeq })
+	queue := append(slices.Clone(r.nextUp), rest...)
+
+	var promoted []*client
+	for i, side := range open {
+		if i == len(queue) {
+			break
+		}
+		next := queue[i]
+		delete(r.spectators, next.id)
+		r.unqueueLocked(next)
+		next.setSeat(r, side)
+		next.moveDir.Store(0)
+		next.mouseY.Store(mouseUnused)
+		r.players[side] = next
+		r.touch()
+		r.eventLocked("spectator_promoted", next)
+		promoted = append(promoted, next)
+	}
+	return promoted
+}
+
+// expireRoom ends a room whose current match has run cfg.maxRoomAge, which
+// no normal match should. A match still in play ends with reason "timeout"
+// and its gameover is broadcast before the room closes. It reports whether r
+// was expired.
+func (h *hub) expireRoom(r *room, now time.Time) bool {
+	r.mu.Lock()
+	if now.Sub(r.setupAt) < r.cfg.maxRoomAge {
+		r.mu.Unlock()
+		return false
+	}
+	log.Printf("room %s still on one match after %s, closing it", r.id, r.cfg.maxRoomAge)
+	if r.liveLocked() {
+		r.finishLocked("timeout")
+	}
+	r.mu.Unlock()
+
+	for _, ev := range r.takeOutbox() {
+		payload, _ := json.Marshal(ev)
+		r.broadcast(payload)
+	}
+	h.closeRoom(r, "timeout")
+	return true
+}
+
+// orphaned reports whether spectators have been left watching an empty
+// table for cfg.orphanGrace, in which case the room should be closed.
+// Reserved rooms are exempt until their reservation runs out.
+func (r *room) orphaned(now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.bench || r.players[0] != nil || r.players[1] != nil || len(r.spectators) == 0 ||
+		now.Before(r.reservedUntil) {
+		r.orphanedSince = time.Time{}
+		return false
+	}
+	if r.orphanedSince.IsZero() {
+		r.orphanedSince = now
+	}
+	return now.Sub(r.orphanedSince) >= r.cfg.orphanGrace
+}
+
+func newRoom(n int, cfg config) *room {
+	r := &room{
+		id:         "room-" + itoa(n),
+		cfg:        cfg,
+		spectators: make(map[string]*client),
+		serveMode:  cfg.serveMode,
+		phase:      phaseWaiting,
+		rules:      defaultRoomConfig(),
+		paddleLen:  [2]float64{paddleH, paddleH},
+		balls:      make([]ball, cfg.balls),
+		clock:      time.Now,
+	}
+	r.createdAt = r.clock()
+	r.setupAt = r.createdAt
+	r.reseedLocked()
+	r.centerLocked()
+	r.touch()
+	return r
+}
+
+// reseedLocked gives the room a fresh seed for the next match. Seeds stay
+// under 2^53 so they survive a round trip through JavaScript numbers.
+func (r *room) reseedLocked() {
+	r.seed = rand.Uint64() >> 11
+	r.rng = rand.New(rand.NewPCG(r.seed, r.seed))
+}
+
+// touch records player activity for the idle sweep.
+func (r *room) touch() {
+	r.lastInput.Store(time.Now().UnixNano())
+}
+
+// idle reports whether the room has gone idleTimeout without player input
+// while no match was in play.
+func (r *room) idle(now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.bench || r.phase == phasePlaying && r.filledLocked(0) && r.filledLocked(1) && !r.away[0] && !r.away[1] {
+		return false
+	}
+	if !r.reservedUntil.IsZero() {
+		if now.Before(r.reservedUntil) {
+			return false
+		}
+		if r.emptyLocked() {
+			return true
+		}
+		// A tournament match that hasn't started by then is forfeited by
+		// whoever didn't show up; closeRoom reports it.
+		if r.seats != ([2]string{}) && r.startTime.IsZero() && !(r.filledLocked(0) && r.filledLocked(1)) {
+			return true
+		}
+	}
+	return now.Sub(time.Unix(0, r.lastInput.Load())) >= r.cfg.idleTimeout
+}
+
+// centerLocked puts the paddles and stationary balls back in the middle.
+// Extra balls are spread down the center line.
+func (r *room) centerLocked() {
+	r.paddleY[0] = (r.cfg.worldH - r.paddleLen[0]) / 2
+	r.paddleY[1] = (r.cfg.worldH - r.paddleLen[1]) / 2
+
+	for i := range r.balls {
+		r.balls[i] = ball{
+			x:       r.cfg.worldW / 2,
+			y:       r.cfg.worldH * float64(i+1) / float64(len(r.balls)+1),
+			lastHit: -1,
+		}
+	}
+}
+
+// resetRoundLocked re-centers and serves. conceded is the side that just lost
+// a point, or -1 for the first serve of a match.
+func (r *room) resetRoundLocked(conceded int) {
+	r.resetRallyLocked()
+	r.centerLocked()
+	for i := range r.balls {
+		r.serveLocked(&r.balls[i], conceded)
+	}
+	r.lastTick = r.clock()
+	r.serveTicks = r.serveTicksLocked()
+}
+
+// serveTicksLocked is the configured serve delay in ticks.
+func (r *room) serveTicksLocked() int {
+	return int(r.cfg.serveDelay * time.Duration(r.cfg.tickRate) / time.Second)
+}
+
+// serveLocked launches b from where it stands.
+func (r *room) serveLocked(b *ball, conceded int) {
+	limit := r.rules.serveAngle()
+	angle := r.rng.Float64()*2*limit - limit
+	dir := r.serveDirLocked(conceded)
+	b.vx = dir * r.rules.BallSpeed
+	b.vy = math.Tan(angle) * r.rules.BallSpeed
+	b.lastHit = -1
+}
+
+// respawnLocked puts a ball that went out back on the center line and serves
+// it, leaving the rest of a multi-ball rally in play.
+func (r *room) respawnLocked(b *ball, conceded int) {
+	r.resetRallyLocked()
+	b.x = r.cfg.worldW / 2
+	b.y = r.cfg.worldH / 2
+	r.serveLocked(b, conceded)
+}
+
+// setReady marks side as ready to start. The countdown begins in step once
+// both sides are ready.
+func (r *room) setReady(side int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.phase != phaseWaiting || side < 0 || side > 1 || r.players[side] == nil {
+		return
+	}
+	r.ready[side] = true
+}
+
+// requestRematch records that side wants to play again. It reports true once
+// both players have agreed, in which case the caller should restart the room.
+func (r *room) requestRematch(side int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.phase != phaseFinished || side < 0 || side > 1 || r.players[side] == nil {
+		return false
+	}
+	r.rematch[side] = true
+	if (r.rematch[0] || r.bot[0]) && (r.rematch[1] || r.bot[1]) {
+		r.rematch = [2]bool{}
+		return true
+	}
+	r.outbox = append(r.outbox, wsOut{Type: "rematch_pending", Data: wsOutRematch{Ready: r.rematch}})
+	return false
+}
+
+// restart starts a fresh match in the same room with the same players.
+// Both have already agreed, so it goes straight to the countdown.
+func (r *room) restart() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.restartLocked()
+}
+
+// restartLocked is restart for callers already holding r.mu.
+func (r *room) restartLocked() {
+	r.score = [2]int{}
+	r.setsWon = [2]int{}
+	r.points = 0
+	r.overtime = false
+	r.rematch = [2]bool{}
+	r.clearPowerupsLocked()
+	r.reseedLocked()
+	r.startTime = time.Time{}
+	r.endTime = time.Time{}
+	r.finishTime = time.Time{}
+	r.setupAt = r.clock()
+	r.phase = phaseCountdown
+	r.countdownEnd = r.clock().Add(countdownDuration)
+	r.centerLocked()
+}
+
+// serveDirLocked picks the next serve direction according to the room's
+// serve mode and records it in the serve history.
+func (r *room) serveDirLocked(conceded int) float64 {
+	dir := 1.0
+	switch {
+	case r.serveMode == serveLoser && conceded >= 0:
+		if conceded == 0 {
+			dir = -1
+		}
+	case r.serveMode == serveAlternate:
+		if (r.points/alternateEvery)%2 == 1 {
+			dir = -1
+		}
+	case r.serveMode == serveBalanced:
+		if r.serveRun >= maxServeRun {
+			dir = -r.lastServe
+			break
+		}
+		// Lean toward whichever side has received fewer serves so far.
+		pRight := clamp(0.5+0.15*float64(r.serveCount[0]-r.serveCount[1]), 0.1, 0.9)
+		if r.rng.Float64() >= pRight {
+			dir = -1
+		}
+	default:
+		if r.rng.IntN(2) == 0 {
+			dir = -1
+		}
+	}
+
+	if dir == r.lastServe {
+		r.serveRun++
+	} else {
+		r.lastServe = dir
+		r.serveRun = 1
+	}
+	if dir < 0 {
+		r.serveCount[0]++
+	} else {
+		r.serveCount[1]++
+	}
+	return dir
+}
+
+func (r *room) step(dt float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	running := r.filledLocked(0) && r.filledLocked(1)
+	if !running || r.away[0] || r.away[1] {
+		return
+	}
+
+	now := r.clock()
+	if r.checkStallLocked(now) {
+		return
+	}
+	r.checkAFKLocked(now)
+	switch r.phase {
+	case phaseWaiting:
+		if (r.ready[0] || r.bot[0]) && (r.ready[1] || r.bot[1]) {
+			r.phase = phaseCountdown
+			r.countdownEnd = now.Add(countdownDuration)
 		}
-		if c.name != "" {
-			spectators = append(spectators, c.name)
+		return
+	case phaseCountdown:
+		if now.Before(r.countdownEnd) {
+			return
+		}
+		// The set clock starts with the first serve; the match is timed
+		// from the first set.
+		r.phase = phasePlaying
+		r.ready = [2]bool{}
+		if r.startTime.IsZero() {
+			r.startTime = now
+			r.setupAt = now
+			r.tick = 0
+			r.timeline, r.timelineStride = nil, 1
+			r.longestRally = 0
+			if r.cfg.recordInputs {
+				r.rec = newRecorder(r.rules)
+			}
+		}
+		r.endTime = now.Add(r.cfg.matchDuration)
+		r.activeSince = now
+		r.afkWarned = [2]bool{}
+		r.resetRoundLocked(-1)
+	case phaseFinished:
+		// Bench rooms play on for as long as they are open.
+		if r.bench {
+			r.restartLocked()
+		}
+		return
+	}
+	r.tick++
+	r.sampleLocked()
+	if !r.overtime && !r.endTime.IsZero() && now.After(r.endTime) {
+		r.recordClockEndLocked()
+		if r.score[0] != r.score[1] {
+			r.endSetLocked("time")
+			return
+		}
+		// Level at full time: play on until the next point.
+		r.overtime = true
+	}
+
+	worldW, worldH := r.cfg.worldW, r.cfg.worldH
+
+	// Apply paddle movement.
+	for side := 0; side < 2; side++ {
+		if r.bot[side] {
+			r.stepBotLocked(side, dt)
+			continue
+		}
+		p := r.players[side]
+		if p == nil {
+			continue
+		}
+		h := r.paddleLen[side]
+		r.ackSeq[side] = p.inputSeq.Load()
+		y, dir := p.mouseY.Load(), p.moveDir.Load()
+		if y == mouseUnused {
+			r.recordInputLocked(side, int(dir), -1)
 		} else {
-			spectators = append(spectators, c.id)
+			r.recordInputLocked(side, int(dir), int(y))
+		}
+		if y != mouseUnused {
+			// Chase the pointer at keyboard speed rather than teleporting.
+			target := clamp(float64(y)-h/2, 0, worldH-h)
+			if math.Abs(target-r.paddleY[side]) > mouseDeadZone {
+				maxStep := r.rules.PaddleSpeed * dt
+				r.paddleY[side] += clamp(target-r.paddleY[side], -maxStep, maxStep)
+			}
+		} else {
+			r.paddleY[side] = clamp(r.paddleY[side]+float64(dir)*r.rules.PaddleSpeed*dt, 0, worldH-h)
+		}
+	}
+
+	// Paddles can line up while the serve is held.
+	if r.serveTicks > 0 {
+		r.serveTicks--
+		return
+	}
+
+	for i := range r.balls {
+		r.moveBallLocked(&r.balls[i], dt)
+	}
+
+	if r.cfg.powerups {
+		r.stepPowerupsLocked()
+	}
+
+	// Scoring. A point can end the set or reset every ball, so stop at the
+	// first one unless the others are still in play.
+	for i := range r.balls {
+		b := &r.balls[i]
+		scorer := -1
+		if b.x+r.rules.BallRadius < 0 {
+			scorer = 1
+		} else if b.x-r.rules.BallRadius > worldW {
+			scorer = 0
+		}
+		if scorer < 0 {
+			continue
+		}
+		r.pointLocked(scorer, b)
+		if r.phase != phasePlaying || len(r.balls) == 1 {
+			return
 		}
 	}
+}
+
+// moveBallLocked advances b by dt, bouncing it off the walls and paddles.
+func (r *room) moveBallLocked(b *ball, dt float64) {
+	worldW, worldH := r.cfg.worldW, r.cfg.worldH
+	radius, width := r.rules.BallRadius, r.rules.PaddleW
+
+	prevX, prevY := b.x, b.y
+	b.x += b.vx * dt
+	b.y += b.vy * dt
+	// The path before any wall bounce, for the paddle sweep below.
+	pathY := b.y
 
-	running := r.players[0] != nil && r.players[1] != nil
-	if !r.endTime.IsZero() && time.Now().After(r.endTime) {
+	// Wall bounce (top/bottom).
+	if b.y-radius < 0 {
+		b.y = radius
+		b.vy *= -1
+	}
+	if b.y+radius > worldH {
+		b.y = worldH - radius
+		b.vy *= -1
+	}
+
+	// Paddle collisions.
+	leftFaceX := float64(paddleMargin + width)
+	rightFaceX := worldW - paddleMargin - width
+	leftPaddleX := float64(paddleMargin)
+	rightPaddleX := worldW - paddleMargin - width
+
+	// A fast ball can move further than a paddle's width in one tick, so
+	// first sweep its path: if its leading edge crossed a paddle face this
+	// tick, it bounces from where it crossed. Otherwise fall back to the
+	// overlap test, which catches a paddle moving onto the ball.
+	if b.vx < 0 && b.x-radius <= leftFaceX {
+		py := r.paddleY[0]
+		if y, ok := r.sweepLocked(prevX-radius, b.x-radius, leftFaceX, prevY, pathY); ok && y >= py && y <= py+r.paddleLen[0] {
+			b.x, b.y = leftFaceX+radius, y
+			r.bounceOffPaddle(b, 0)
+		} else if b.y >= py && b.y <= py+r.paddleLen[0] && b.x+radius >= leftPaddleX {
+			b.x = leftFaceX + radius
+			r.bounceOffPaddle(b, 0)
+		}
+	}
+	if b.vx > 0 && b.x+radius >= rightFaceX {
+		py := r.paddleY[1]
+		if y, ok := r.sweepLocked(prevX+radius, b.x+radius, rightFaceX, prevY, pathY); ok && y >= py && y <= py+r.paddleLen[1] {
+			b.x, b.y = rightFaceX-radius, y
+			r.bounceOffPaddle(b, 1)
+		} else if b.y >= py && b.y <= py+r.paddleLen[1] && b.x-radius <= rightPaddleX+width {
+			b.x = rightFaceX - radius
+			r.bounceOffPaddle(b, 1)
+		}
+	}
+}
+
+// sweepLocked reports whether an edge moving from x0 to x1 this tick crossed
+// the face at faceX, and if so the ball's y at the crossing, interpolated
+// between y0 and y1 and kept off the walls.
+func (r *room) sweepLocked(x0, x1, faceX, y0, y1 float64) (float64, bool) {
+	if x0 == x1 || (x0-faceX)*(x1-faceX) > 0 {
+		return 0, false
+	}
+	t := (x0 - faceX) / (x0 - x1)
+	radius := r.rules.BallRadius
+	return clamp(y0+t*(y1-y0), radius, r.cfg.worldH-radius), true
+}
+
+// pointLocked awards a point to side for ball b going out, then serves the
+// next round, or ends the set if it was the golden point in overtime. With
+// several balls in play only b is served again.
+func (r *room) pointLocked(side int, b *ball) {
+	r.score[side]++
+	r.points++
+	r.outbox = append(r.outbox, wsOut{Type: "scored", Data: wsOutScored{
+		Side:  side,
+		Score: r.score,
+		Rally: r.rallyHits,
+	}})
+	if r.overtime {
+		r.endSetLocked("overtime")
+		return
+	}
+	if n := r.cfg.swapPoints; n > 0 && (r.score[0]+r.score[1])%n == 0 {
+		r.swapSidesLocked()
+		side = 1 - side
+	}
+	if len(r.balls) > 1 {
+		r.respawnLocked(b, 1-side)
+		return
+	}
+	r.resetRoundLocked(1 - side)
+}
+
+// endSetLocked credits the current set to whoever leads it, then either ends
+// the match, if that clinched a majority of cfg.sets, or breaks before the
+// next set. A set only ends with one side ahead.
+func (r *room) endSetLocked(reason string) {
+	winner := 0
+	if r.score[1] > r.score[0] {
+		winner = 1
+	}
+	r.setsWon[winner]++
+	if r.setsWon[winner] > r.cfg.sets/2 {
+		r.finishLocked(reason)
+		return
+	}
+
+	r.outbox = append(r.outbox, wsOut{Type: "set_over", Data: wsOutSetOver{
+		Score:  r.score,
+		Winner: winner,
+		Sets:   r.setsWon,
+	}})
+	r.score = [2]int{}
+	r.overtime = false
+	r.endTime = time.Time{}
+	r.phase = phaseCountdown
+	r.countdownEnd = r.clock().Add(setBreakDuration)
+	r.clearPowerupsLocked()
+	r.centerLocked()
+	if r.cfg.swapPerSet {
+		r.swapSidesLocked()
+	}
+}
+
+// liveLocked reports whether a match is under way: being played, paused,
+// or in the break between sets.
+func (r *room) liveLocked() bool {
+	switch r.phase {
+	case phasePlaying, phasePaused:
+		return true
+	case phaseCountdown:
+		return !r.startTime.IsZero()
+	}
+	return false
+}
+
+// emptyLocked reports whether nobody is seated or watching.
+func (r *room) emptyLocked() bool {
+	return r.players[0] == nil && r.players[1] == nil && len(r.spectators) == 0
+}
+
+// colorsLocked returns each side's paddle color, or "" for an empty side.
+func (r *room) colorsLocked() [2]string {
+	var colors [2]string
+	for side := 0; side < 2; side++ {
+		if p := r.players[side]; p != nil {
+			colors[side] = p.displayColor()
+		} else if r.bot[side] {
+			colors[side] = defaultColor
+		}
+	}
+	return colors
+}
+
+// colors is colorsLocked for callers without r.mu.
+func (r *room) colors() [2]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.colorsLocked()
+}
+
+// spectatorNames is spectatorNamesLocked for callers without r.mu.
+func (r *room) spectatorNames() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.spectatorNamesLocked()
+}
+
+// spectatorRenamed queues the spectator list, and the "next up" queue if
+// anyone is in it, after one of r's spectators changes name.
+func (r *room) spectatorRenamed() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.outbox = append(r.outbox, wsOut{Type: "spectators", Data: r.spectatorNamesLocked()})
+	if len(r.nextUp) > 0 {
+		r.nextUpChangedLocked()
+	}
+}
+
+// playerNames is each side's playerNameLocked, for callers without r.mu.
+func (r *room) playerNames() [2]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.playerNamesLocked()
+}
+
+func (r *room) playerNamesLocked() [2]string {
+	return [2]string{r.playerNameLocked(0), r.playerNameLocked(1)}
+}
+
+// playerRenamed queues the player names after one of r's players changes
+// name.
+func (r *room) playerRenamed() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.outbox = append(r.outbox, wsOut{Type: "players", Data: r.playerNamesLocked()})
+}
+
+// playerNameLocked is the display name for side, "bot" for the practice AI,
+// or empty if the slot is free.
+func (r *room) playerNameLocked(side int) string {
+	if p := r.players[side]; p != nil {
+		return p.displayName()
+	}
+	if r.bot[side] {
+		return "bot"
+	}
+	return ""
+}
+
+// playerUserIDLocked is the stable user id for side, or empty for anonymous
+// players, bots and free slots.
+func (r *room) playerUserIDLocked(side int) string {
+	if p := r.players[side]; p != nil {
+		return p.userID
+	}
+	return ""
+}
+
+// filledLocked reports whether side has a player or a bot.
+func (r *room) filledLocked(side int) bool {
+	return r.players[side] != nil || r.bot[side]
+}
+
+// stepBotLocked moves a bot paddle toward where it last decided the ball
+// would be, at a capped speed.
+func (r *room) stepBotLocked(side int, dt float64) {
+	r.botThink[side] -= dt
+	if r.botThink[side] <= 0 {
+		r.botThink[side] = botReactSecs
+		// Track the nearest ball heading this way, or drift back to center
+		// while every ball is heading away.
+		r.botTargetY[side] = r.cfg.worldH / 2
+		paddleX := float64(paddleMargin)
+		if side == 1 {
+			paddleX = r.cfg.worldW - paddleMargin
+		}
+		nearest := math.Inf(1)
+		for _, b := range r.balls {
+			if (side == 0) != (b.vx < 0) {
+				continue
+			}
+			if d := math.Abs(b.x - paddleX); d < nearest {
+				nearest = d
+				r.botTargetY[side] = b.y
+			}
+		}
+	}
+
+	center := r.paddleY[side] + r.paddleLen[side]/2
+	delta := clamp(r.botTargetY[side]-center, -botSpeedPxS*dt, botSpeedPxS*dt)
+	r.paddleY[side] = clamp(r.paddleY[side]+delta, 0, r.cfg.worldH-r.paddleLen[side])
+}
+
+// finishLocked ends the match in favor of whoever is ahead and queues the
+// gameover message. It is a no-op if the match has already finished.
+func (r *room) finishLocked(reason string) {
+	// A single set is decided on points; a series on sets.
+	tally := r.score
+	if r.cfg.sets > 1 {
+		tally = r.setsWon
+	}
+	winner := -1
+	if tally[0] > tally[1] {
+		winner = 0
+	} else if tally[1] > tally[0] {
+		winner = 1
+	}
+	r.finishAsLocked(reason, winner)
+}
+
+// finishAsLocked ends the match with the given winner, regardless of the
+// score. It is a no-op if the match has already finished.
+func (r *room) finishAsLocked(reason string, winner int) {
+	if r.phase == phaseFinished {
+		return
+	}
+	r.phase = phaseFinished
+	serverMetrics.matchesCompleted.Add(1)
+
+	end := r.clock()
+	if !r.overtime && !r.endTime.IsZero() && end.After(r.endTime) {
+		end = r.endTime
+	}
+	r.finishTime = end
+	seconds := r.elapsedLocked(end)
+	// The rally in play when the match ends counts too.
+	r.longestRally = max(r.longestRally, r.rallyHits)
+
+	userIDs := [2]string{r.playerUserIDLocked(0), r.playerUserIDLocked(1)}
+	if r.ratings != nil {
+		r.ratings.record(userIDs, winner)
+	}
+	if r.results != nil {
+		res := MatchResult{
+			RoomID:       r.id,
+			Players:      [2]string{r.playerNameLocked(0), r.playerNameLocked(1)},
+			UserIDs:      userIDs,
+			Score:        r.score,
+			Sets:         r.setsWon,
+			Winner:       winner,
+			Seed:         r.seed,
+			Start:        r.startTime,
+			End:          end,
+			EndReason:    reason,
+			Replay:       r.replayLocked(),
+			Timeline:     r.timeline,
+			LongestRally: r.longestRally,
+		}
+		r.rec = nil
+		r.timeline = nil
+		go r.results.Record(res)
+	}
+	if r.onFinish != nil {
+		go r.onFinish(winner)
+	}
+
+	r.outbox = append(r.outbox, wsOut{Type: "gameover", Data: wsOutGameOver{
+		Score:        r.score,
+		Sets:         r.setsWon,
+		Winner:       winner,
+		Seed:         r.seed,
+		Seconds:      seconds,
+		EndReason:    reason,
+		LongestRally: r.longestRally,
+	}})
+	r.recordRecentLocked(recentMatch{
+		Players:   r.playerNamesLocked(),
+		Score:     r.score,
+		Sets:      r.setsWon,
+		Winner:    winner,
+		Seconds:   seconds,
+		EndReason: reason,
+	})
+}
+
+// eventLocked queues a membership event about c for everyone in the room.
+// Spectator changes also send the new spectator list, which binary clients
+// don't get in their state frames.
+func (r *room) eventLocked(kind string, c *client) {
+	r.outbox = append(r.outbox, wsOut{Type: "event", Data: wsOutEvent{
+		Kind:     kind,
+		ClientID: c.id,
+		Name:     c.displayName(),
+		Color:    c.displayColor(),
+		Side:     c.side,
+	}})
+	if strings.HasPrefix(kind, "spectator_") {
+		r.outbox = append(r.outbox, wsOut{Type: "spectators", Data: r.spectatorNamesLocked()})
+	}
+}
+
+// takeOutbox returns and clears the queued outbound messages.
+func (r *room) takeOutbox() []wsOut {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := r.outbox
+	r.outbox = nil
+	return out
+}
+
+// recipients returns the players and spectators currently in the room.
+func (r *room) recipients() []*client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]*client, 0, 2+len(r.spectators))
+	for side := 0; side < 2; side++ {
+		if p := r.players[side]; p != nil && !r.away[side] {
+			out = append(out, p)
+		}
+	}
+	for _, s := range r.spectators {
+		if s != nil {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// broadcast sends payload to everyone in the room without blocking.
+func (r *room) broadcast(payload []byte) {
+	for _, c := range r.recipients() {
+		c.trySend(payload)
+	}
+}
+
+// broadcastState sends state to everyone in the room, as JSON or in the
+// binary encoding depending on what each client opted into, shaped for its
+// protocol version. Each encoding is built at most once.
+func (r *room) broadcastState(state wsOutState) {
+	v1 := state
+	v1.AckSeq = nil
+	byVersion := [3]wsOutState{1: v1, 2: state}
+
+	var text, bin [3][]byte
+	for _, c := range r.recipients() {
+		v := max(c.version, 1)
+		if c.binary.Load() {
+			if bin[v] == nil {
+				s := byVersion[v]
+				bin[v] = s.appendBinary(make([]byte, 0, stateBinarySize))
+			}
+			c.trySendBinary(bin[v])
+			continue
+		}
+		if text[v] == nil {
+			text[v], _ = json.Marshal(wsOut{Type: "state", Data: byVersion[v]})
+		}
+		c.trySend(text[v])
+	}
+}
+
+// Paddle bounces leave at up to the room's bounce angle, by default
+// defaultBounceAngle radians (about 50 degrees), from the horizontal. The
+// angle blends spin from where the ball hit the paddle with bounceCarry of
+// the angle it came in at, so a steep ball keeps some of its slope even off
+// the paddle's center.
+const (
+	defaultBounceAngle = 0.9
+	bounceCarry        = 0.3
+)
+
+// In Shrink rooms, paddles lose rallyShrinkStep of their height every
+// rallyShrinkEvery paddle hits, down to rallyShrinkFloor of full size.
+const (
+	rallyShrinkEvery = 4
+	rallyShrinkStep  = 0.1
+	rallyShrinkFloor = 0.4
+)
+
+// rallyScaleLocked is the fraction of rules.PaddleH the current rally
+// leaves the paddles.
+func (r *room) rallyScaleLocked() float64 {
+	if !r.rules.Shrink {
+		return 1
+	}
+	return max(rallyShrinkFloor, 1-rallyShrinkStep*float64(r.rallyHits/rallyShrinkEvery))
+}
+
+// resetRallyLocked starts a new rally, restoring Shrink paddles.
+func (r *room) resetRallyLocked() {
+	r.longestRally = max(r.longestRally, r.rallyHits)
+	r.rallyHits = 0
+	if r.rules.Shrink {
+		r.resizePaddlesLocked()
+	}
+}
+
+func (r *room) bounceOffPaddle(b *ball, side int) {
+	b.lastHit = side
+	r.rallyHits++
+	r.longestRally = max(r.longestRally, r.rallyHits)
+	if r.rules.Shrink && r.rallyHits%rallyShrinkEvery == 0 {
+		r.resizePaddlesLocked()
+	}
+	p, h := r.paddleY[side], r.paddleLen[side]
+	rel := (b.y - (p + h/2)) / (h / 2) // -1..1
+	rel = clamp(rel, -1, 1)
+
+	speed := math.Hypot(b.vx, b.vy)
+	speed = clamp(speed*r.rules.speedRamp(), r.rules.BallSpeed, r.rules.MaxBallSpeed)
+
+	in := math.Atan2(b.vy, math.Abs(b.vx))
+	limit := r.rules.bounceAngle()
+	angle := (1-bounceCarry)*rel*limit + bounceCarry*in
+	angle = clamp(angle, -limit, limit)
+
+	// Send the ball away from the paddle that hit it, whichever way it was
+	// going, with spin from the hit position.
+	dir := 1.0
+	if side == 1 {
+		dir = -1
+	}
+	b.vx = dir * speed * math.Cos(angle)
+	b.vy = speed * math.Sin(angle)
+}
+
+// serverStart anchors the monotonic timestamps sent in state.
+var serverStart = time.Now()
+
+// snapshot captures the room state as of now, the tick's clock reading.
+func (r *room) snapshot(now time.Time) wsOutState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	running := r.filledLocked(0) && r.filledLocked(1) && r.phase == phasePlaying && !r.away[0] && !r.away[1]
+	if !r.overtime && !r.endTime.IsZero() && now.After(r.endTime) {
 		running = false
 	}
 
-	return wsOutState{
-		PaddleY:     r.paddleY,
-		BallX:       r.ballX,
-		BallY:       r.ballY,
+	var latency [2]int
+	for side := 0; side < 2; side++ {
+		if p := r.players[side]; p != nil {
+			latency[side] = int(time.Duration(p.rtt.Load()).Milliseconds())
+		}
+	}
+
+	ackSeq := r.ackSeq
+	countdown := 0
+	if r.phase == phaseCountdown {
+		countdown = int(math.Ceil(r.countdownEnd.Sub(now).Seconds()))
+	}
+
+	s := wsOutState{
+		PaddleY:        r.paddleY,
+		PaddleH:        r.paddleLen,
+		BallX:          r.balls[0].x,
+		BallY:          r.balls[0].y,
+		BallVX:         r.balls[0].vx,
+		BallVY:         r.balls[0].vy,
+		BallSpeed:      math.Hypot(r.balls[0].vx, r.balls[0].vy),
+		Balls:          extraBalls(r.balls),
+		Score:          r.score,
+		Sets:           r.setsWon,
+		Colors:         r.colorsLocked(),
+		AckSeq:         &ackSeq,
+		Running:        running,
+		Phase:          string(r.phase),
+		Ready:          r.ready,
+		Countdown:      max(countdown, 0),
+		Overtime:       r.overtime,
+		Latency:        latency,
+		SecondsLeft:    r.secondsLeftLocked(),
+		ElapsedSeconds: r.elapsedLocked(now),
+		Rally:          r.rallyHits,
+		LongestRally:   r.longestRally,
+		Powerups:       slices.Clone(r.powerups),
+		ServerTime:     now.Sub(serverStart).Milliseconds(),
+	}
+	if r.phase == phasePlaying && r.serveTicks > 0 {
+		s.Serving = true
+		s.ServeDir = 1
+		if r.balls[0].vx < 0 {
+			s.ServeDir = -1
+		}
+		s.BallVX, s.BallVY = 0, 0
+		for i := range s.Balls {
+			s.Balls[i].VX, s.Balls[i].VY = 0, 0
+		}
+	}
+	return s
+}
+
+// spectatorNamesLocked lists the display names of the room's spectators.
+func (r *room) spectatorNamesLocked() []string {
+	names := make([]string, 0, len(r.spectators))
+	for _, c := range r.spectators {
+		if c == nil {
+			continue
+		}
+		names = append(names, c.displayName())
+	}
+	return names
+}
+
+// Binary state frame layout, little-endian:
+//
+//	[0]      stateBinaryType
+//	[1:5]    paddleY[0] float32
+//	[5:9]    paddleY[1] float32
+//	[9:13]   ballX float32
+//	[13:17]  ballY float32
+//	[17:19]  score[0] uint16
+//	[19:21]  score[1] uint16
+//	[21]     flags: bit0 running, bit1 overtime, bit2 ready[0], bit3 ready[1],
+//	         bits4-6 phase (0 waiting, 1 countdown, 2 playing, 3 finished,
+//	         4 paused)
+//	[22:24]  secondsLeft uint16
+//	[24]     countdown uint8
+//	[25:29]  ballVX float32
+//	[29:33]  ballVY float32
+//	[33:37]  serverTime uint32, milliseconds
+//	[37]     sets[0] uint8
+//	[38]     sets[1] uint8
+//	[39:41]  paddleH[0] uint16
+//	[41:43]  paddleH[1] uint16
+//	[43]     power-up count n, then n records of 9 bytes:
+//	         kind uint8 (0 grow, 1 shrink, 2 slow), x float32, y float32
+//	then     ball count m (0 in single-ball play), then m records of 16
+//	         bytes: x, y, vx, vy float32
+//	then     elapsedSeconds uint16
+//	then     ackSeq[0], ackSeq[1] uint32, zero for v1 clients
+//	then     rally uint16, longestRally uint16
+//	then     serveDir int8: -1 left, 1 right, 0 unless serving
+//	then     ballSpeed uint16, px/s
+//	then     latency[0], latency[1] uint16, ms
+//
+// Fields are only ever added at the end, so older clients can read a
+// prefix and skip the rest.
+//
+// Spectator names aren't included; like JSON clients, binary clients get
+// "spectators" events.
+const (
+	stateBinaryType = 1
+	stateBinarySize = 66 // without power-ups or extra balls
+)
+
+var phaseCodes = map[string]byte{
+	string(phaseWaiting):   0,
+	string(phaseCountdown): 1,
+	string(phasePlaying):   2,
+	string(phaseFinished):  3,
+	string(phasePaused):    4,
+}
+
+// appendBinary appends the binary encoding of s to b.
+func (s wsOutState) appendBinary(b []byte) []byte {
+	b = append(b, stateBinaryType)
+	for _, f := range []float64{s.PaddleY[0], s.PaddleY[1], s.BallX, s.BallY} {
+		b = binary.LittleEndian.AppendUint32(b, math.Float32bits(float32(f)))
+	}
+	b = binary.LittleEndian.AppendUint16(b, uint16(s.Score[0]))
+	b = binary.LittleEndian.AppendUint16(b, uint16(s.Score[1]))
+
+	var flags byte
+	if s.Running {
+		flags |= 1 << 0
+	}
+	if s.Overtime {
+		flags |= 1 << 1
+	}
+	if s.Ready[0] {
+		flags |= 1 << 2
+	}
+	if s.Ready[1] {
+		flags |= 1 << 3
+	}
+	flags |= phaseCodes[s.Phase] << 4
+	b = append(b, flags)
+
+	b = binary.LittleEndian.AppendUint16(b, uint16(s.SecondsLeft))
+	b = append(b, byte(s.Countdown))
+
+	b = binary.LittleEndian.AppendUint32(b, math.Float32bits(float32(s.BallVX)))
+	b = binary.LittleEndian.AppendUint32(b, math.Float32bits(float32(s.BallVY)))
+	b = binary.LittleEndian.AppendUint32(b, uint32(s.ServerTime))
+	b = append(b, byte(s.Sets[0]), byte(s.Sets[1]))
+	b = binary.LittleEndian.AppendUint16(b, uint16(s.PaddleH[0]))
+	b = binary.LittleEndian.AppendUint16(b, uint16(s.PaddleH[1]))
+	b = append(b, byte(len(s.Powerups)))
+	for _, p := range s.Powerups {
+		b = append(b, powerupCodes[p.Kind])
+		b = binary.LittleEndian.AppendUint32(b, math.Float32bits(float32(p.X)))
+		b = binary.LittleEndian.AppendUint32(b, math.Float32bits(float32(p.Y)))
+	}
+	b = append(b, byte(len(s.Balls)))
+	for _, bl := range s.Balls {
+		for _, f := range []float64{bl.X, bl.Y, bl.VX, bl.VY} {
+			b = binary.LittleEndian.AppendUint32(b, math.Float32bits(float32(f)))
+		}
+	}
+	b = binary.LittleEndian.AppendUint16(b, uint16(s.ElapsedSeconds))
+	var ack [2]uint32
+	if s.AckSeq != nil {
+		ack = *s.AckSeq
+	}
+	b = binary.LittleEndian.AppendUint32(b, ack[0])
+	b = binary.LittleEndian.AppendUint32(b, ack[1])
+	b = binary.LittleEndian.AppendUint16(b, uint16(s.Rally))
+	b = binary.LittleEndian.AppendUint16(b, uint16(s.LongestRally))
+	b = append(b, byte(int8(s.ServeDir)))
+	b = binary.LittleEndian.AppendUint16(b, uint16(s.BallSpeed))
+	for _, ms := range s.Latency {
+		b = binary.LittleEndian.AppendUint16(b, uint16(min(ms, math.MaxUint16)))
+	}
+	return b
+}
+
+// secondsLeftLocked is the time remaining on the match clock, or the full
+// duration if the match hasn't started.
+func (r *room) secondsLeftLocked() int {
+	if r.endTime.IsZero() {
+		return int(r.cfg.matchDuration.Seconds())
+	}
+	return max(int(r.endTime.Sub(r.clock()).Seconds()), 0)
+}
+
+// elapsedLocked is how long the match has run at now, stopping when it
+// finishes, or 0 before the first serve.
+func (r *room) elapsedLocked(now time.Time) int {
+	if r.startTime.IsZero() {
+		return 0
+	}
+	if !r.finishTime.IsZero() {
+		now = r.finishTime
+	}
+	return max(int(now.Sub(r.startTime).Seconds()), 0)
+}
+
+// info summarizes the room. The bool result is false for rooms with nobody
+// left in them, and for private and bench rooms, which aren't listed.
+func (r *room) info() (roomInfo, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.code != "" || r.bench {
+		return roomInfo{}, false
+	}
+	players := 0
+	for side := 0; side < 2; side++ {
+		if r.filledLocked(side) {
+			players++
+		}
+	}
+	if r.players[0] == nil && r.players[1] == nil && len(r.spectators) == 0 {
+		return roomInfo{}, false
+	}
+
+	return roomInfo{
+		ID:          r.id,
+		Full:        players == 2,
 		Score:       r.score,
-		Running:     running,
-		SecondsLeft: secondsLeft,
-		Spectators:  spectators,
+		SecondsLeft: r.secondsLeftLocked(),
+		Spectators:  len(r.spectators),
+	}, true
+}
+
+// roomList returns summaries of all non-empty public rooms ordered by id.
+func (h *hub) roomList() []roomInfo {
+	h.mu.Lock()
+	rooms := make([]*room, 0, len(h.rooms))
+	for _, r := range h.rooms {
+		rooms = append(rooms, r)
+	}
+	h.mu.Unlock()
+
+	list := make([]roomInfo, 0, len(rooms))
+	for _, r := range rooms {
+		if info, ok := r.info(); ok {
+			list = append(list, info)
+		}
 	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
 }
 
 func clamp(v, lo, hi float64) float64 {
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFastBallDoesNotTunnel(t *testing.T) {
+	cfg := defaultConfig()
+	dt := 1 / float64(cfg.tickRate)
+	for side := 0; side < 2; side++ {
+		for _, at := range []string{"center", "top edge", "bottom edge"} {
+			r := newRoom(0, cfg)
+			r.rules.MaxBallSpeed = customRange["maxBallSpeed"][1]
+			speed := r.rules.MaxBallSpeed // several paddle widths per tick
+			radius := r.rules.BallRadius
+
+			y := r.paddleY[side] + r.paddleLen[side]/2
+			switch at {
+			case "top edge":
+				y = r.paddleY[side] + 1
+			case "bottom edge":
+				y = r.paddleY[side] + r.paddleLen[side] - 1
+			}
+			// Start just short of the face, heading into it.
+			b := &r.balls[0]
+			b.y, b.vy, b.lastHit = y, 0, -1
+			if side == 0 {
+				b.x, b.vx = paddleMargin+r.rules.PaddleW+radius+2, -speed
+			} else {
+				b.x, b.vx = cfg.worldW-paddleMargin-r.rules.PaddleW-radius-2, speed
+			}
+
+			r.moveBallLocked(b, dt)
+			if b.lastHit != side {
+				t.Errorf("side %d, %s: %g px/s ball went through the paddle", side, at, speed)
+				continue
+			}
+			if (side == 0) != (b.vx > 0) {
+				t.Errorf("side %d, %s: vx = %g after the bounce, want it heading back", side, at, b.vx)
+			}
+		}
+	}
+}
+
+func TestBounceDirectionAndSpeed(t *testing.T) {
+	r := newRoom(0, defaultConfig())
+	r.rules.SpeedRamp = 1 // so the speed should come back unchanged
+	speed := r.rules.BallSpeed
+	want := speed
+	for side := 0; side < 2; side++ {
+		top, h := r.paddleY[side], r.paddleLen[side]
+		for _, hit := range []struct {
+			name string
+			y    float64
+		}{
+			{"center", top + h/2},
+			{"top edge", top},
+			{"bottom edge", top + h},
+		} {
+			// Either incoming direction, as on a glancing hit the ball
+			// may already be moving away.
+			for _, in := range []float64{-1, 1} {
+				b := &ball{y: hit.y, vx: in * speed * 0.8, vy: speed * 0.6}
+				r.bounceOffPaddle(b, side)
+				if away := b.vx > 0 == (side == 0); !away {
+					t.Errorf("side %d, %s, vx in %g: vx out %g, want away from the paddle", side, hit.name, in*speed*0.8, b.vx)
+				}
+				if got := math.Hypot(b.vx, b.vy); math.Abs(got-want) > 1e-9 {
+					t.Errorf("side %d, %s: speed %g, want %g", side, hit.name, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestBinaryStateKeepsAckSeqOffset(t *testing.T) {
+	s := wsOutState{
+		ElapsedSeconds: 7,
+		AckSeq:         &[2]uint32{11, 22},
+		Rally:          3,
+		LongestRally:   5,
+		ServeDir:       -1,
+		BallSpeed:      450,
+		Latency:        [2]int{35, 1 << 20},
+	}
+	b := s.appendBinary(nil)
+	if len(b) != stateBinarySize {
+		t.Fatalf("frame is %d bytes, want %d", len(b), stateBinarySize)
+	}
+	// v2 clients read elapsedSeconds and then ackSeq right after the
+	// power-up and ball counts, both zero here.
+	const off = 45
+	le := binary.LittleEndian
+	if got := le.Uint16(b[off:]); got != 7 {
+		t.Errorf("elapsedSeconds = %d, want 7", got)
+	}
+	if got := [2]uint32{le.Uint32(b[off+2:]), le.Uint32(b[off+6:])}; got != *s.AckSeq {
+		t.Errorf("ackSeq = %v, want %v", got, *s.AckSeq)
+	}
+	if got := [2]uint16{le.Uint16(b[off+10:]), le.Uint16(b[off+12:])}; got != [2]uint16{3, 5} {
+		t.Errorf("rally, longestRally = %v, want [3 5] after ackSeq", got)
+	}
+	if got := int8(b[off+14]); got != -1 {
+		t.Errorf("serveDir = %d, want -1", got)
+	}
+	if got := le.Uint16(b[off+15:]); got != 450 {
+		t.Errorf("ballSpeed = %d, want 450", got)
+	}
+	// Latency is last, a huge one pinned to the field's maximum.
+	if got := [2]uint16{le.Uint16(b[off+17:]), le.Uint16(b[off+19:])}; got != [2]uint16{35, 65535} {
+		t.Errorf("latency = %v, want [35 65535]", got)
+	}
+
+	// v1 frames have the same shape, with ackSeq zeroed.
+	s.AckSeq = nil
+	v1 := s.appendBinary(nil)
+	if len(v1) != len(b) || le.Uint64(v1[off+2:]) != 0 || le.Uint16(v1[off+10:]) != 3 {
+		t.Errorf("v1 frame % x, want the v2 layout with ackSeq zeroed", v1)
+	}
+}
+
+func TestBroadcastRacesDisconnect(t *testing.T) {
+	h := newHub(defaultConfig(), &memoryStore{})
+	for round := 0; round < 20; round++ {
+		h.mu.Lock()
+		r := h.newRoomLocked()
+		var watchers []*client
+		r.mu.Lock()
+		for i := 0; i < 20; i++ {
+			c := &client{id: r.id + "-s" + itoa(i), send: make(chan outFrame, 4)}
+			c.mouseY.Store(mouseUnused)
+			h.addSpectatorLocked(r, c)
+			watchers = append(watchers, c)
+		}
+		r.mu.Unlock()
+		h.mu.Unlock()
+
+		var wg sync.WaitGroup
+		stop := make(chan struct{})
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					r.broadcast([]byte(`{"type":"event"}`))
+					r.broadcastState(r.snapshot(time.Now()))
+				}
+			}()
+		}
+		// Hang up everyone the way readPump's defer does, while the
+		// broadcasts above still hold their pointers.
+		for _, c := range watchers {
+			h.disconnect(c)
+			c.closeSend()
+		}
+		close(stop)
+		wg.Wait()
+
+		for _, c := range watchers {
+			if c.trySend([]byte("late")) {
+				t.Fatalf("send to %s succeeded after its channel closed", c.id)
+			}
+		}
+	}
+}
+
+func TestBalancedServes(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.serveMode = serveBalanced
+	for seed := uint64(1); seed <= 20; seed++ {
+		r := newSimulation(cfg, defaultRoomConfig(), seed).room
+		run, last, worst := 0, 0.0, 0
+		for i := 0; i < 1000; i++ {
+			dir := r.serveDirLocked(i % 2)
+			if dir == last {
+				run++
+			} else {
+				run, last = 1, dir
+			}
+			if run > maxServeRun {
+				t.Fatalf("seed %d: %d serves in a row toward %g", seed, run, dir)
+			}
+			d := r.serveCount[0] - r.serveCount[1]
+			worst = max(worst, d, -d)
+		}
+		// The lean toward the side served less keeps the tally close
+		// all along, not just at the end.
+		if worst > 4 {
+			t.Errorf("seed %d: serves drifted %d apart (final %v)", seed, worst, r.serveCount)
+		}
+	}
+}
+
+func TestRoomAgeCountsFromCurrentMatch(t *testing.T) {
+	h := newHub(defaultConfig(), &memoryStore{})
+	h.mu.Lock()
+	r := h.newRoomLocked()
+	h.mu.Unlock()
+	now := time.Now()
+	age := r.cfg.maxRoomAge
+	r.mu.Lock()
+	r.clock = func() time.Time { return now }
+	// Open for ages, with a rematch just started.
+	r.createdAt = now.Add(-2 * age)
+	r.restartLocked()
+	r.mu.Unlock()
+
+	if h.expireRoom(r, now.Add(age/2)) {
+		t.Fatal("a rematch room was closed for the time spent on earlier matches")
+	}
+	if !h.expireRoom(r, now.Add(age)) {
+		t.Fatal("a match that ran past maxRoomAge wasn't ended")
+	}
+}
+
+func TestShardRoomsPartition(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.shards = 4
+	h := newHub(cfg, &memoryStore{})
+	h.mu.Lock()
+	for i := 0; i < 40; i++ {
+		h.newRoomLocked()
+	}
+	h.mu.Unlock()
+
+	seen := make(map[*room]int)
+	for shard := 0; shard < cfg.shards; shard++ {
+		for _, r := range h.shardRooms(shard) {
+			if prev, ok := seen[r]; ok {
+				t.Fatalf("%s is in shards %d and %d", r.id, prev, shard)
+			}
+			seen[r] = shard
+		}
+	}
+	if len(seen) != len(h.rooms) {
+		t.Errorf("shards cover %d of %d rooms", len(seen), len(h.rooms))
+	}
+
+	// Closed rooms drop out of their shard.
+	for r := range seen {
+		h.closeRoom(r, "done")
+	}
+	for shard := 0; shard < cfg.shards; shard++ {
+		if rooms := h.shardRooms(shard); len(rooms) != 0 {
+			t.Errorf("shard %d still steps %d closed rooms", shard, len(rooms))
+		}
+	}
+}
+
+func TestPrivateRoomJoinsOnlyByCode(t *testing.T) {
+	h := newHub(defaultConfig(), &memoryStore{})
+	h.mu.Lock()
+	r := h.newPrivateRoomLocked(defaultRoomConfig())
+	h.mu.Unlock()
+
+	c := &client{id: "c", side: -1, send: make(chan outFrame, 8)}
+	c.mouseY.Store(mouseUnused)
+	if err := h.joinByRoomID(c, r.id, -1, "", ""); err != errRoomNotFound {
+		t.Fatalf("joining a private room by its id: err %v, want %v", err, errRoomNotFound)
+	}
+	if room, _ := c.seat(); room != nil {
+		t.Fatal("joined a private room by its id")
+	}
+	if err := h.joinByRoomID(c, strings.ToLower(r.code), -1, "", ""); err != nil {
+		t.Fatalf("joining by code: %v", err)
+	}
+	if room, _ := c.seat(); room != r {
+		t.Error("joining by code didn't seat the client")
+	}
+}
+
+func TestRoomListHidesPrivateAndBench(t *testing.T) {
+	h := newHub(defaultConfig(), &memoryStore{})
+	public := fullRoom(h)
+	h.mu.Lock()
+	private := h.newPrivateRoomLocked(defaultRoomConfig())
+	host := &client{id: "host", side: 0}
+	host.mouseY.Store(mouseUnused)
+	private.players[0] = host
+	h.mu.Unlock()
+	bench, err := h.createBenchRoom(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.closeRoom(bench, "done")
+
+	list := h.roomList()
+	if len(list) != 1 || list[0].ID != public.id {
+		t.Errorf("roomList = %+v, want only %s", list, public.id)
+	}
+}
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"compress/flate"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -21,131 +28,561 @@ var allowedOrigins = map[string]struct{}{
 	"https://127.0.0.1:8080": {},
 }
 
+// Versions of the message protocol, negotiated as WebSocket subprotocols.
+// v2 adds input acks to state; a client that names no version gets v1.
+const (
+	protoV1 = "pong.v1"
+	protoV2 = "pong.v2"
+)
+
+var protocolVersions = map[string]int{protoV1: 1, protoV2: 2}
+
+// protocolVersion picks the version for r's upgrade: the newest one it
+// offers, or 1 if it offers none. ok is false if it offers only versions
+// this server doesn't speak.
+func protocolVersion(r *http.Request) (version int, ok bool) {
+	offered := websocket.Subprotocols(r)
+	if len(offered) == 0 {
+		return 1, true
+	}
+	for _, p := range offered {
+		version = max(version, protocolVersions[p])
+	}
+	return version, version > 0
+}
+
 var wsUpgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	// Newest first, so the handshake settles on the version
+	// protocolVersion picked.
+	Subprotocols: []string{protoV2, protoV1},
 	CheckOrigin: func(r *http.Request) bool {
 		origin := r.Header.Get("Origin")
+		if origin == "" {
+			// Browsers always send an Origin; native clients and tools
+			// usually don't.
+			return globalHub.cfg.allowNoOrigin
+		}
 		_, ok := allowedOrigins[origin]
 		return ok
 	},
 }
 
-var globalHub = newHub()
+// readTimeout drops a connection that has sent nothing, not even a pong,
+// for this long.
+const readTimeout = 60 * time.Second
+
+// globalHub is set up by main once the configuration is loaded.
+var globalHub *hub
 
 var nextClientID atomic.Int64
 
 func handleWS(w http.ResponseWriter, r *http.Request) {
+	// Tokens are optional; without a verifier they are ignored and the
+	// client plays anonymously.
+	var ident Identity
+	if tok := bearerToken(r); tok != "" && globalHub.auth != nil {
+		var err error
+		if ident, err = globalHub.auth.Verify(tok); err != nil {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	// Browsers fail a handshake that doesn't echo one of their
+	// subprotocols, so an unknown version is refused before upgrading.
+	version, ok := protocolVersion(r)
+	if !ok {
+		http.Error(w, "unsupported protocol version; this server speaks "+protoV1+" and "+protoV2, http.StatusBadRequest)
+		return
+	}
+
+	ip := remoteIP(r, globalHub.cfg.trustProxy)
+	if !globalHub.conns.acquire(ip) {
+		http.Error(w, "too many connections", http.StatusTooManyRequests)
+		return
+	}
+
 	conn, err := wsUpgrader.Upgrade(w, r, nil)
 	if err != nil {
+		globalHub.conns.release(ip)
 		log.Printf("upgrade: %v", err)
 		return
 	}
+	if globalHub.cfg.compression {
+		// State goes out at the tick rate; favor CPU over ratio. This is a
+		// no-op for clients that didn't negotiate deflate.
+		_ = conn.SetCompressionLevel(flate.BestSpeed)
+	}
 
 	c := &client{
-		id:   fmt.Sprintf("c-%d", nextClientID.Add(1)),
-		conn: conn,
-		send: make(chan []byte, 64),
-		side: -1,
+		id:      fmt.Sprintf("c-%d", nextClientID.Add(1)),
+		name:    sanitizeName(ident.Name),
+		userID:  ident.UserID,
+		token:   newResumeToken(),
+		ip:      ip,
+		version: version,
+		conn:    conn,
+		send:    make(chan outFrame, 64),
+		side:    -1,
 	}
-	c.mouseY.Store(-1)
+	q := r.URL.Query()
+	c.mouseY.Store(mouseUnused)
+	c.binary.Store(q.Get("format") == "binary")
+	c.setName(q.Get("name"))
+	colorOK := c.setColor(q.Get("color"))
+	c.willing.Store(q.Has("play"))
+	globalHub.register(c)
 
-	// Default behavior: join matchmaking queue. Client may later send "join".
-	globalHub.assignToRoom(c)
+	// A reconnecting client passes its token as ?resume= to take back its
+	// player slot, or its place in the stands, before matchmaking can pair
+	// it with someone already waiting. A ?room= link joins that room
+	// straight away, like a "join" message. Otherwise, or if the room can't
+	// take c, c joins the matchmaking queue; it may still send "join" later.
+	var joinErr error
+	switch token, id := q.Get("resume"), q.Get("room"); {
+	case token != "":
+		if !globalHub.resume(c, token) {
+			joinErr = globalHub.resumeSpectate(c, token)
+		}
+	case id != "":
+		// A malformed ?side= just means no preference.
+		prefer := -1
+		if n, err := strconv.Atoi(q.Get("side")); err == nil {
+			prefer, _ = preferredSide(&n)
+		}
+		// Passwords aren't taken from the URL, where proxies log them; a
+		// locked room is joined with a "join" message instead.
+		joinErr = globalHub.joinByRoomID(c, id, prefer, "", "")
+	}
+	// A spectator whose room has closed is told so and left out of
+	// matchmaking, as with "resume_spectate".
+	roomGone := errors.Is(joinErr, errRoomGone)
+	if room, _ := c.seat(); room == nil && !roomGone {
+		globalHub.assignToRoom(c)
+	}
 
 	// Welcome message.
-	hello := wsOut{Type: "hello", Data: wsOutHello{ClientID: c.id, RoomID: roomID(c), Side: c.side, W: worldW, H: worldH}}
-	b, _ := json.Marshal(hello)
-	c.send <- b
+	b, _ := json.Marshal(helloFor(c))
+	c.trySend(b)
+	switch {
+	case roomGone:
+		payload, _ := json.Marshal(wsOut{Type: "room_closed", Data: wsOutRoomClosed{Reason: "gone"}})
+		c.trySend(payload)
+	case joinErr != nil:
+		sendError(c, joinErr.Error())
+	}
+	if !colorOK {
+		sendError(c, "unknown color: "+q.Get("color"))
+	}
 
 	go writePump(c)
 	readPump(c)
 }
 
 func roomID(c *client) string {
-	if c.room == nil {
+	r, _ := c.seat()
+	if r == nil {
 		return ""
 	}
-	return c.room.id
+	return r.id
+}
+
+func helloFor(c *client) wsOut {
+	cfg := globalHub.cfg
+	r, side := c.seat()
+	hello := wsOutHello{
+		ClientID:     c.id,
+		UserID:       c.userID,
+		Name:         c.name,
+		Color:        c.displayColor(),
+		RoomID:       roomID(c),
+		Token:        c.token,
+		Side:         side,
+		W:            int(cfg.worldW),
+		H:            int(cfg.worldH),
+		Margin:       paddleMargin,
+		TickRate:     cfg.tickRate,
+		BroadcastHz:  cfg.tickRate / cfg.broadcastEvery(),
+		MatchSeconds: int(cfg.matchDuration.Seconds()),
+		Sets:         cfg.sets,
+		Balls:        cfg.balls,
+		Powerups:     cfg.powerups,
+	}
+	// Rooms may have their own tuning; outside one, show the defaults.
+	rules := defaultRoomConfig()
+	if r != nil {
+		hello.Code = r.code
+		hello.Colors = r.colors()
+		hello.Players = r.playerNames()
+		hello.Recent = r.recentMatches()
+		hello.Spectators = r.spectatorNames()
+		hello.NextUp = r.nextUpList()
+		rules = r.rules
+	}
+	hello.Rules = &rules
+	if c.userID != "" {
+		hello.Rating = int(math.Round(globalHub.ratings.get(c.userID)))
+	}
+	return wsOut{Type: "hello", Data: hello}
 }
 
 func readPump(c *client) {
 	defer func() {
-		globalHub.removeClient(c)
-		close(c.send)
+		globalHub.unregister(c)
+		globalHub.disconnect(c)
+		c.closeSend()
 		_ = c.conn.Close()
+		globalHub.conns.release(c.ip)
 	}()
 
 	c.conn.SetReadLimit(1 << 20)
-	_ = c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-	c.conn.SetPongHandler(func(string) error {
-		_ = c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	_ = c.conn.SetReadDeadline(time.Now().Add(readTimeout))
+	c.conn.SetPongHandler(func(appData string) error {
+		now := time.Now()
+		_ = c.conn.SetReadDeadline(now.Add(readTimeout))
+		// Pings carry their send time, so the pong echoes it back.
+		if sent, err := strconv.ParseInt(appData, 10, 64); err == nil {
+			c.rtt.Store(int64(now.Sub(time.Unix(0, sent))))
+		}
 		return nil
 	})
 
 	for {
-		var msg wsIn
-		if err := c.conn.ReadJSON(&msg); err != nil {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
 			return
 		}
+		var msg wsIn
+		if err := json.Unmarshal(data, &msg); err != nil {
+			if c.allowInput(time.Now()) {
+				sendError(c, "invalid message: "+err.Error())
+			}
+			continue
+		}
+		// Over budget, drop the message. Movement is coalesced instead:
+		// dropping it could leave a paddle drifting after a lost "stop", so
+		// its value is kept as the latest input, which the tick reads once,
+		// but nothing else is done for it.
+		if !c.allowInput(time.Now()) {
+			switch msg.Type {
+			case "move":
+				var m wsInMove
+				if json.Unmarshal(msg.Data, &m) == nil {
+					c.steer(m)
+				}
+			case "mouse":
+				var m wsInMouse
+				if json.Unmarshal(msg.Data, &m) == nil {
+					c.point(m, globalHub.cfg.worldH)
+				}
+			}
+			continue
+		}
 
 		switch msg.Type {
 		case "join":
 			var j wsInJoin
 			if err := json.Unmarshal(msg.Data, &j); err != nil {
+				sendError(c, "invalid "+msg.Type+" data: "+err.Error())
 				continue
 			}
-			c.name = j.Name
+			c.setName(j.Name)
+			if !c.setColor(j.Color) {
+				sendError(c, "unknown color: "+j.Color)
+			}
+			if j.Binary {
+				c.binary.Store(true)
+			}
+			c.willing.Store(j.Play)
 			// Only spectators can join by room id.
-			if c.side != -1 {
+			if _, side := c.seat(); side != -1 {
 				continue
 			}
-			if !globalHub.joinByRoomID(c, j.RoomID) {
-				payload, _ := json.Marshal(wsOut{Type: "error", Data: "room not found"})
-				select {
-				case c.send <- payload:
-				default:
+			prefer, err := preferredSide(j.Side)
+			if err != nil {
+				sendError(c, err.Error())
+				continue
+			}
+			if err := globalHub.joinByRoomID(c, j.RoomID, prefer, j.Password, j.Seat); err != nil {
+				sendError(c, err.Error())
+				continue
+			}
+			payload, _ := json.Marshal(helloFor(c))
+			c.trySend(payload)
+		case "spectate":
+			var j wsInJoin
+			if len(msg.Data) > 0 {
+				if err := json.Unmarshal(msg.Data, &j); err != nil {
+					sendError(c, "invalid "+msg.Type+" data: "+err.Error())
+					continue
+				}
+			}
+			c.setName(j.Name)
+			if !c.setColor(j.Color) {
+				sendError(c, "unknown color: "+j.Color)
+			}
+			if j.Binary {
+				c.binary.Store(true)
+			}
+			c.willing.Store(j.Play)
+			// Only clients still in matchmaking can pick a match to watch.
+			if r, _ := c.seat(); r != nil {
+				continue
+			}
+			if err := globalHub.spectateLive(c); err != nil {
+				sendError(c, err.Error())
+				continue
+			}
+			payload, _ := json.Marshal(helloFor(c))
+			c.trySend(payload)
+		case "create":
+			// Only clients still in matchmaking can create a room.
+			if r, _ := c.seat(); r != nil {
+				continue
+			}
+			var m wsInCreate
+			if len(msg.Data) > 0 {
+				if err := json.Unmarshal(msg.Data, &m); err != nil {
+					sendError(c, "invalid "+msg.Type+" data: "+err.Error())
+					continue
 				}
+			}
+			rc, err := m.rules(globalHub.cfg)
+			if err != nil {
+				sendError(c, err.Error())
+				continue
+			}
+			side, err := preferredSide(m.Side)
+			if err != nil {
+				sendError(c, err.Error())
+				continue
+			}
+			if len(m.Password) > maxPasswordLen {
+				sendError(c, errLongPassword.Error())
+				continue
+			}
+			if _, err := globalHub.createRoom(c, rc, side, m.Password); err != nil {
+				sendQueueFull(c)
+				continue
+			}
+			payload, _ := json.Marshal(helloFor(c))
+			c.trySend(payload)
+		case "resume":
+			var m wsInResume
+			if err := json.Unmarshal(msg.Data, &m); err != nil {
+				sendError(c, "invalid "+msg.Type+" data: "+err.Error())
+				continue
+			}
+			// Only a connection still in matchmaking can take over a slot.
+			if r, _ := c.seat(); r != nil || !globalHub.resume(c, m.Token) {
+				sendError(c, "resume failed")
+				continue
+			}
+			payload, _ := json.Marshal(helloFor(c))
+			c.trySend(payload)
+		case "resume_spectate":
+			var m wsInResume
+			if err := json.Unmarshal(msg.Data, &m); err != nil {
+				sendError(c, "invalid "+msg.Type+" data: "+err.Error())
+				continue
+			}
+			// Like resume, only from matchmaking.
+			if r, _ := c.seat(); r != nil {
+				sendError(c, errResumeFailed.Error())
 				continue
 			}
-			hello := wsOut{Type: "hello", Data: wsOutHello{ClientID: c.id, RoomID: roomID(c), Side: c.side, W: worldW, H: worldH}}
-			payload, _ := json.Marshal(hello)
-			select {
-			case c.send <- payload:
-			default:
+			err := globalHub.resumeSpectate(c, m.Token)
+			if errors.Is(err, errRoomGone) {
+				payload, _ := json.Marshal(wsOut{Type: "room_closed", Data: wsOutRoomClosed{Reason: "gone"}})
+				c.trySend(payload)
+				continue
+			}
+			if err != nil {
+				sendError(c, err.Error())
+				continue
 			}
+			payload, _ := json.Marshal(helloFor(c))
+			c.trySend(payload)
+		case "practice":
+			if r, _ := c.seat(); r != nil {
+				continue
+			}
+			if _, err := globalHub.createPracticeRoom(c); err != nil {
+				sendQueueFull(c)
+				continue
+			}
+			payload, _ := json.Marshal(helloFor(c))
+			c.trySend(payload)
 		case "move":
 			var m wsInMove
 			if err := json.Unmarshal(msg.Data, &m); err != nil {
+				sendError(c, "invalid "+msg.Type+" data: "+err.Error())
 				continue
 			}
-			if m.Dir < -1 {
-				m.Dir = -1
-			}
-			if m.Dir > 1 {
-				m.Dir = 1
+			c.steer(m)
+			c.lastMove.Store(time.Now().UnixNano())
+			if r, side := c.seat(); r != nil && side >= 0 {
+				r.touch()
 			}
-			c.moveDir.Store(int32(m.Dir))
-			c.mouseY.Store(-1)
 		case "mouse":
 			var m wsInMouse
 			if err := json.Unmarshal(msg.Data, &m); err != nil {
+				sendError(c, "invalid "+msg.Type+" data: "+err.Error())
+				continue
+			}
+			c.point(m, globalHub.cfg.worldH)
+			c.lastMove.Store(time.Now().UnixNano())
+			if r, side := c.seat(); r != nil && side >= 0 {
+				r.touch()
+			}
+		case "leave":
+			if r, _ := c.seat(); r == nil {
+				continue
+			}
+			globalHub.leaveRoom(c)
+			globalHub.assignToRoom(c)
+			payload, _ := json.Marshal(helloFor(c))
+			c.trySend(payload)
+		case "ready":
+			if r, side := c.seat(); r != nil {
+				r.touch()
+				r.setReady(side)
+			}
+		case "rematch":
+			if r, side := c.seat(); r != nil {
+				r.touch()
+				if r.requestRematch(side) {
+					r.restart()
+				}
+			}
+		case "chat":
+			var m wsInChat
+			if err := json.Unmarshal(msg.Data, &m); err != nil {
+				sendError(c, "invalid "+msg.Type+" data: "+err.Error())
 				continue
 			}
-			c.mouseY.Store(int32(m.Y))
-			c.moveDir.Store(0)
+			r, side := c.seat()
+			text := sanitizeChat(m.Text)
+			if r == nil || text == "" {
+				continue
+			}
+			if !c.allowChat(time.Now()) {
+				sendError(c, "chatting too fast")
+				continue
+			}
+			payload, _ := json.Marshal(wsOut{Type: "chat", Data: wsOutChat{Name: c.displayName(), Side: side, Text: text}})
+			r.broadcast(payload)
+		case "react":
+			var m wsInReact
+			if err := json.Unmarshal(msg.Data, &m); err != nil {
+				sendError(c, "invalid "+msg.Type+" data: "+err.Error())
+				continue
+			}
+			r, side := c.seat()
+			if r == nil || !reactions[m.Code] || !c.allowReaction(time.Now()) {
+				continue
+			}
+			payload, _ := json.Marshal(wsOut{Type: "reaction", Data: wsOutReaction{Name: c.displayName(), Side: side, Code: m.Code}})
+			r.broadcast(payload)
+		case "kick":
+			var m wsInKick
+			if err := json.Unmarshal(msg.Data, &m); err != nil {
+				sendError(c, "invalid "+msg.Type+" data: "+err.Error())
+				continue
+			}
+			target, err := globalHub.kickSpectator(c, m.ClientID)
+			if err != nil {
+				sendError(c, err.Error())
+				continue
+			}
+			payload, _ := json.Marshal(wsOut{Type: "kicked"})
+			target.trySend(payload)
+			time.AfterFunc(shutdownFlush, func() {
+				closeConn(target, websocket.ClosePolicyViolation, "kicked")
+			})
+		case "queue":
+			var m wsInQueue
+			if len(msg.Data) > 0 {
+				if err := json.Unmarshal(msg.Data, &m); err != nil {
+					sendError(c, "invalid "+msg.Type+" data: "+err.Error())
+					continue
+				}
+			}
+			r, _ := c.seat()
+			if r == nil {
+				sendError(c, errNotSpectating.Error())
+				continue
+			}
+			if err := r.queueToPlay(c, m.Leave); err != nil {
+				sendError(c, err.Error())
+			}
 		case "name":
 			var j wsInJoin
 			if err := json.Unmarshal(msg.Data, &j); err != nil {
+				sendError(c, "invalid "+msg.Type+" data: "+err.Error())
+				continue
+			}
+			c.setName(j.Name)
+			if !c.setColor(j.Color) {
+				sendError(c, "unknown color: "+j.Color)
+			}
+			if r, side := c.seat(); r != nil && side < 0 {
+				r.spectatorRenamed()
+			} else if r != nil {
+				r.playerRenamed()
+			}
+		case "debug_reset_round":
+			// Without DEBUG_ENDPOINTS the debug messages don't exist.
+			if !globalHub.cfg.debug {
+				sendError(c, "unknown message type: "+msg.Type)
+				continue
+			}
+			if r, side := c.seat(); r != nil && side >= 0 {
+				r.debugResetRound()
+			}
+		case "debug_set_score":
+			if !globalHub.cfg.debug {
+				sendError(c, "unknown message type: "+msg.Type)
+				continue
+			}
+			var m wsInDebugScore
+			if err := json.Unmarshal(msg.Data, &m); err != nil {
+				sendError(c, "invalid "+msg.Type+" data: "+err.Error())
 				continue
 			}
-			c.name = j.Name
+			if r, side := c.seat(); r != nil && side >= 0 {
+				if err := r.debugSetScore(m.Score); err != nil {
+					sendError(c, err.Error())
+				}
+			}
+		default:
+			sendError(c, "unknown message type: "+msg.Type)
 		}
 	}
 }
 
+// sendError reports a problem with a client's message without closing the
+// connection.
+func sendError(c *client, text string) {
+	payload, _ := json.Marshal(wsOut{Type: "error", Data: text})
+	c.trySend(payload)
+}
+
+// sendQueueFull tells c the server is at its room limit and it is waiting
+// in matchmaking for a room to free up.
+func sendQueueFull(c *client) {
+	payload, _ := json.Marshal(wsOut{Type: "queue_full"})
+	c.trySend(payload)
+}
+
+// writePump sends c's queued frames and pings. It returns on the first
+// write error, and closing the connection on the way out fails readPump's
+// blocked read at once, so readPump's defer takes c out of its room without
+// waiting for readTimeout.
 func writePump(c *client) {
-	ticker := time.NewTicker(30 * time.Second)
+	ticker := time.NewTicker(globalHub.cfg.pingInterval)
 	defer func() {
 		ticker.Stop()
 		_ = c.conn.Close()
@@ -159,12 +596,17 @@ func writePump(c *client) {
 				_ = c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
-			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+			kind := websocket.TextMessage
+			if msg.binary {
+				kind = websocket.BinaryMessage
+			}
+			if err := c.conn.WriteMessage(kind, msg.data); err != nil {
 				return
 			}
 		case <-ticker.C:
 			_ = c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			sent := strconv.FormatInt(time.Now().UnixNano(), 10)
+			if err := c.conn.WriteMessage(websocket.PingMessage, []byte(sent)); err != nil {
 				return
 			}
 		}
@@ -179,16 +621,70 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, "./web/index.html")
 }
 
+// loopStaleAfter is how long a game loop can go without finishing a tick
+// before /healthz reports the server unhealthy: several ticks even at a
+// TICK_RATE of 1.
+const loopStaleAfter = 5 * time.Second
+
+// handleHealthz is a liveness probe for the game loops as well as the HTTP
+// listener: it fails once any loop has stopped ticking.
 func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if shard := serverMetrics.staleShard(time.Now()); shard >= 0 {
+		http.Error(w, fmt.Sprintf("game loop %d stalled", shard), http.StatusServiceUnavailable)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 	_, _ = w.Write([]byte("ok"))
 }
 
+func handleRooms(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(globalHub.roomList())
+}
+
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	results, err := globalHub.results.All()
+	if err != nil {
+		log.Printf("stats: %v", err)
+		http.Error(w, "stats unavailable", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(summarize(results))
+}
+
 func main() {
-	go runLoop(globalHub)
+	cfg := loadConfig()
+	results, err := newResultStore(cfg)
+	if err != nil {
+		log.Fatalf("results store: %v", err)
+	}
+	globalHub = newHub(cfg, results)
+	if all, err := results.All(); err != nil {
+		log.Printf("ratings: %v", err)
+	} else {
+		globalHub.ratings.replay(all)
+	}
+	wsUpgrader.EnableCompression = cfg.compression
+
+	serverMetrics.initShards(cfg.shards)
+	for shard := 0; shard < cfg.shards; shard++ {
+		go runLoop(globalHub, shard)
+	}
 
 	http.HandleFunc("/", handleIndex)
 	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("GET /rooms", handleRooms)
+	http.HandleFunc("GET /metrics", handleMetrics)
+	http.HandleFunc("GET /stats", handleStats)
+	http.HandleFunc("GET /replay/{roomId}", handleReplay)
+	http.HandleFunc("POST /matches", handleCreateMatch)
+	http.HandleFunc("POST /tournaments", handleCreateTournament)
+	http.HandleFunc("GET /tournaments/{id}", handleTournament)
+	if cfg.debug {
+		http.HandleFunc("GET /debug/room/{id}", handleDebugRoom)
+		http.HandleFunc("POST /debug/benchroom", handleBenchRooms)
+	}
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("./web/static"))))
 	http.HandleFunc("/ws", handleWS)
 
@@ -198,59 +694,133 @@ func main() {
 	}
 
 	addr := ":" + port
-	log.Printf("Pong server listening on %s", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Fatal(err)
+	srv := &http.Server{Addr: addr}
+	go func() {
+		var err error
+		if cfg.tlsCert != "" {
+			log.Printf("Pong server listening on %s (TLS)", addr)
+			err = srv.ListenAndServeTLS(cfg.tlsCert, cfg.tlsKey)
+		} else {
+			log.Printf("Pong server listening on %s", addr)
+			err = srv.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+
+	log.Printf("shutting down")
+	shutdown(srv, globalHub)
+}
+
+// Shutdown timing: how long writePumps get to flush the notice, and how long
+// the HTTP server gets to finish in-flight requests.
+const (
+	shutdownFlush   = 500 * time.Millisecond
+	shutdownTimeout = 5 * time.Second
+)
+
+// shutdown stops accepting connections, tells every client the server is
+// going away, then closes their sockets with a proper close frame.
+func shutdown(srv *http.Server, h *hub) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// Hijacked WebSocket connections aren't tracked by Shutdown, so this
+	// returns once plain HTTP requests are done.
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("http shutdown: %v", err)
+	}
+
+	// Matches freeze where they are rather than play on unseen.
+	close(h.stop)
+
+	clients := h.allClients()
+	payload, _ := json.Marshal(wsOut{Type: "server_shutdown"})
+	for _, c := range clients {
+		c.trySend(payload)
+	}
+	time.Sleep(shutdownFlush)
+
+	for _, c := range clients {
+		closeConn(c, websocket.CloseGoingAway, "server shutting down")
+	}
+}
+
+// closeConn sends a close frame and closes c's connection. readPump notices
+// and cleans up as for any other disconnect.
+func closeConn(c *client, code int, text string) {
+	// Bench spectators have no connection; ending their send is enough.
+	if c.conn == nil {
+		c.closeSend()
+		return
 	}
+	msg := websocket.FormatCloseMessage(code, text)
+	_ = c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	_ = c.conn.Close()
 }
 
-func runLoop(h *hub) {
-	ticker := time.NewTicker(time.Second / tickRate)
+// runLoop steps and broadcasts the rooms in one shard of the game loop on
+// its own ticker, so a slow room only holds up its shard. Shard 0 also runs
+// matchmaking. It returns once h.stop is closed.
+func runLoop(h *hub, shard int) {
+	tickRate := h.cfg.tickRate
+	ticker := time.NewTicker(time.Second / time.Duration(tickRate))
 	defer ticker.Stop()
+	// Rooms step every tick but send state only every broadcastEvery
+	// ticks; events still go out as they happen.
+	broadcastEvery := h.cfg.broadcastEvery()
 
-	for range ticker.C {
-		h.mu.Lock()
-		rooms := make([]*room, 0, len(h.rooms))
-		for _, r := range h.rooms {
-			rooms = append(rooms, r)
+	for tick := 0; ; tick++ {
+		var due time.Time
+		select {
+		case due = <-ticker.C:
+		case <-h.stop:
+			return
+		}
+		sendState := tick%broadcastEvery == 0
+		if shard == 0 {
+			h.matchWaiting(time.Now())
 		}
-		h.mu.Unlock()
+		rooms := h.shardRooms(shard)
 
+		start := time.Now()
 		dt := 1.0 / float64(tickRate)
 		for _, r := range rooms {
+			if r.isClosed() {
+				continue
+			}
+			if h.expireRoom(r, start) {
+				continue
+			}
+			if r.idle(start) {
+				h.closeRoom(r, "idle")
+				continue
+			}
+			if r.orphaned(start) {
+				h.closeRoom(r, "match_ended")
+				continue
+			}
 			r.step(dt)
-			state := r.snapshot()
-			payload, _ := json.Marshal(wsOut{Type: "state", Data: state})
-
-			// Broadcast to players.
-			for side := 0; side < 2; side++ {
-				p := r.players[side]
-				if p == nil {
-					continue
-				}
-				select {
-				case p.send <- payload:
-				default:
-					// Drop if slow; connection will timeout eventually.
-				}
+			for _, ev := range r.takeOutbox() {
+				payload, _ := json.Marshal(ev)
+				r.broadcast(payload)
 			}
-
-			// Broadcast to spectators.
-			r.mu.Lock()
-			specs := make([]*client, 0, len(r.spectators))
-			for _, s := range r.spectators {
-				specs = append(specs, s)
+			for _, c := range r.takeRehello() {
+				payload, _ := json.Marshal(helloFor(c))
+				c.trySend(payload)
 			}
-			r.mu.Unlock()
-			for _, s := range specs {
-				if s == nil {
-					continue
-				}
-				select {
-				case s.send <- payload:
-				default:
-				}
+			for _, c := range r.takeKicked() {
+				kickAFK(c)
+			}
+			if sendState {
+				r.broadcastState(r.snapshot(start))
 			}
 		}
+		serverMetrics.observeTick(shard, time.Since(start), start.Sub(due))
 	}
 }
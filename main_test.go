@@ -0,0 +1,306 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startServer points globalHub at a fresh hub with cfg and serves /ws from
+// it, returning the WebSocket URL. No game loop runs unless the test starts
+// one. Connections made with dialWS are closed when the test ends.
+func startServer(t *testing.T, cfg config) (*hub, string) {
+	t.Helper()
+	globalHub = newHub(cfg, &memoryStore{})
+	h := globalHub
+	// handleWS returns once its readPump has cleaned up; wait for every
+	// one, after the test's own connections close, so none is left using
+	// globalHub when the next test replaces it.
+	var handlers sync.WaitGroup
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		handleWS(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(handlers.Wait)
+	return h, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// dialWS connects to url as a browser on an allowed origin would.
+func dialWS(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	h := http.Header{"Origin": {"http://localhost:8080"}}
+	conn, _, err := websocket.DefaultDialer.Dial(url, h)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(3 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// fullRoom makes a room with both player slots taken by connectionless
+// clients, so anyone joining it spectates.
+func fullRoom(h *hub) *room {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r := h.newRoomLocked()
+	for side := 0; side < 2; side++ {
+		c := &client{id: r.id + "-p" + itoa(side), room: r, side: side}
+		c.mouseY.Store(mouseUnused)
+		r.players[side] = c
+	}
+	return r
+}
+
+// spectatorCount is how many spectators r has.
+func spectatorCount(r *room) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.spectators)
+}
+
+func TestWriteFailureRemovesClient(t *testing.T) {
+	h, url := startServer(t, defaultConfig())
+	r := fullRoom(h)
+	// The test side never reads, and never writes after the handshake.
+	dialWS(t, url+"?room="+r.id)
+	waitFor(t, "the spectator to join", func() bool { return spectatorCount(r) == 1 })
+
+	r.mu.Lock()
+	var c *client
+	for _, s := range r.spectators {
+		c = s
+	}
+	r.mu.Unlock()
+
+	// Kill only the write side of the server's socket: its reads stay
+	// blocked, so only writePump can notice.
+	if err := c.conn.UnderlyingConn().(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	c.trySend([]byte(`{"type":"ping"}`))
+
+	waitFor(t, "the client to leave its room", func() bool { return spectatorCount(r) == 0 })
+	waitFor(t, "the client to be unregistered", func() bool {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		_, ok := h.clients[c]
+		return !ok
+	})
+}
+
+func TestConnectDisconnectStress(t *testing.T) {
+	h, url := startServer(t, defaultConfig())
+	serverMetrics.initShards(1)
+	loopDone := make(chan struct{})
+	go func() {
+		runLoop(h, 0)
+		close(loopDone)
+	}()
+	defer func() {
+		close(h.stop)
+		<-loopDone
+	}()
+
+	const workers, pairs = 8, 20
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < pairs; i++ {
+				a, err := dialStress(url)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				b, err := dialStress(url)
+				if err != nil {
+					a.Close()
+					t.Error(err)
+					return
+				}
+				// Some pairs hang up mid-match, some from the stands, and
+				// some recolor while the loop is reading their colors.
+				switch i % 3 {
+				case 0:
+					_ = a.WriteJSON(wsOut{Type: "spectate"})
+				case 1:
+					for _, color := range []string{"red", "blue", "green"} {
+						rename := map[string]any{"type": "name", "data": map[string]any{"name": color, "color": color}}
+						_ = a.WriteJSON(rename)
+						_ = b.WriteJSON(rename)
+					}
+				}
+				a.Close()
+				b.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Players who dropped mid-match are held for resume; let the grace
+	// run out at once.
+	waitFor(t, "every connection to close", func() bool {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return len(h.clients) == 0
+	})
+	h.mu.Lock()
+	var held []*client
+	for _, c := range h.resumable {
+		held = append(held, c)
+	}
+	h.mu.Unlock()
+	for _, c := range held {
+		h.expire(c)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.rooms) != 0 || len(h.waitQ) != 0 || len(h.resumable) != 0 {
+		t.Errorf("leaked: %d rooms, %d queued, %d held for resume", len(h.rooms), len(h.waitQ), len(h.resumable))
+	}
+}
+
+// dialStress is dialWS for use off the test goroutine.
+func dialStress(url string) (*websocket.Conn, error) {
+	h := http.Header{"Origin": {"http://localhost:8080"}}
+	conn, _, err := websocket.DefaultDialer.Dial(url, h)
+	return conn, err
+}
+func TestMouseAboveFieldStillSteers(t *testing.T) {
+	h, url := startServer(t, defaultConfig())
+	// The first to queue plays the left paddle.
+	conn := dialWS(t, url)
+	waitFor(t, "the first player to queue", func() bool {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return len(h.waitQ) == 1
+	})
+	dialWS(t, url)
+	var r *room
+	waitFor(t, "the players to be paired", func() bool {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for _, rr := range h.rooms {
+			r = rr
+		}
+		return r != nil
+	})
+
+	// Skip the ready-up and countdown.
+	r.mu.Lock()
+	now := time.Now()
+	r.phase = phasePlaying
+	r.endTime = now.Add(time.Minute)
+	r.activeSince = now
+	p, start := r.players[0], r.paddleY[0]
+	r.mu.Unlock()
+
+	if err := conn.WriteJSON(map[string]any{"type": "mouse", "data": map[string]any{"y": -1}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the mouse input", func() bool { return p.mouseY.Load() != mouseUnused })
+	if y := p.mouseY.Load(); y != 0 {
+		t.Errorf("mouse y -1 stored as %d, want it clamped to 0", y)
+	}
+	dt := 1 / float64(h.cfg.tickRate)
+	for i := 0; i < 5; i++ {
+		r.step(dt)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.paddleY[0] >= start {
+		t.Errorf("paddle at %g, want it moving up from %g toward the pointer", r.paddleY[0], start)
+	}
+}
+
+func TestJoinLeavesPreviousRoom(t *testing.T) {
+	h, url := startServer(t, defaultConfig())
+	a, b := fullRoom(h), fullRoom(h)
+	conn := dialWS(t, url+"?room="+a.id)
+	waitFor(t, "spectating room A", func() bool { return spectatorCount(a) == 1 })
+
+	if err := conn.WriteJSON(map[string]any{"type": "join", "data": map[string]any{"roomId": b.id}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "spectating room B", func() bool { return spectatorCount(b) == 1 })
+	// The move happens under hub.mu; once it is free, the move is done.
+	h.mu.Lock()
+	h.mu.Unlock()
+	if n := spectatorCount(a); n != 0 {
+		t.Errorf("room A still lists %d spectators", n)
+	}
+}
+
+func TestOverBudgetMovesKeepLatest(t *testing.T) {
+	h, url := startServer(t, defaultConfig())
+	r := fullRoom(h)
+	conn := dialWS(t, url+"?room="+r.id)
+	waitFor(t, "the spectator to join", func() bool { return spectatorCount(r) == 1 })
+	r.mu.Lock()
+	var c *client
+	for _, s := range r.spectators {
+		c = s
+	}
+	r.mu.Unlock()
+
+	// Well past the burst, ending on a "stop" that must not be lost.
+	const n = 3 * inputBurst
+	for i := 1; i <= n; i++ {
+		dir := 1
+		if i == n {
+			dir = 0
+		}
+		msg := map[string]any{"type": "move", "data": map[string]any{"dir": dir, "seq": i}}
+		if err := conn.WriteJSON(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "the last move", func() bool { return c.inputSeq.Load() == n })
+	if d := c.moveDir.Load(); d != 0 {
+		t.Errorf("moveDir = %d after a final stop, want 0", d)
+	}
+}
+
+func TestFromLoopbackBehindProxy(t *testing.T) {
+	local := httptest.NewRequest("GET", "/debug/room/r-1", nil)
+	local.RemoteAddr = "127.0.0.1:50000"
+	forwarded := httptest.NewRequest("GET", "/debug/room/r-1", nil)
+	forwarded.RemoteAddr = "127.0.0.1:50001"
+	forwarded.Header.Set("X-Forwarded-For", "203.0.113.7")
+
+	for _, tc := range []struct {
+		name       string
+		r          *http.Request
+		trustProxy bool
+		want       bool
+	}{
+		{"direct", local, false, true},
+		{"direct with TRUST_PROXY", local, true, true},
+		{"through the proxy", forwarded, true, false},
+	} {
+		if got := fromLoopback(tc.r, tc.trustProxy); got != tc.want {
+			t.Errorf("%s: fromLoopback = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// matchReserveTTL is how long a room made over POST /matches is held open
+// before anyone joins it.
+const matchReserveTTL = 5 * time.Minute
+
+// matchOut is the response to POST /matches. Players join by sending
+// "join" with the code; the first to arrive takes the left side.
+type matchOut struct {
+	RoomID     string    `json:"roomId"`
+	Code       string    `json:"code"`
+	JoinPath   string    `json:"joinPath"`
+	TTLSeconds int       `json:"ttlSeconds"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+// reserveRoom makes a private room with no one in it yet, held open until
+// matchReserveTTL has passed. A non-empty password locks it as createRoom's
+// does.
+func (h *hub) reserveRoom(rc roomConfig, password string) (*room, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.fullLocked() {
+		return nil, errServerFull
+	}
+	r := h.newPrivateRoomLocked(rc)
+	r.passwordHash = hashRoomPassword(r.id, password)
+	r.reservedUntil = time.Now().Add(matchReserveTTL)
+	return r, nil
+}
+
+// handleCreateMatch reserves a private room for players to join later. The
+// body, if any, is the same tuning "create" accepts. Browsers are held to
+// the WebSocket's origin list, and with sign-in enabled the caller needs a
+// valid bearer token.
+func handleCreateMatch(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if _, ok := allowedOrigins[origin]; !ok {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+	}
+	if globalHub.auth != nil {
+		if _, err := globalHub.auth.Verify(bearerToken(r)); err != nil {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	var m wsInCreate
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&m); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	rc, err := m.rules(globalHub.cfg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(m.Password) > maxPasswordLen {
+		http.Error(w, errLongPassword.Error(), http.StatusBadRequest)
+		return
+	}
+	room, err := globalHub.reserveRoom(rc, m.Password)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(matchOut{
+		RoomID:     room.id,
+		Code:       room.code,
+		JoinPath:   "/?room=" + room.code,
+		TTLSeconds: int(matchReserveTTL.Seconds()),
+		ExpiresAt:  room.reservedUntil,
+	})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tickBuckets are the upper bounds, in seconds, of the tick duration
+// histogram. A 60Hz loop has about 16.7ms per tick.
+var tickBuckets = []float64{0.0005, 0.001, 0.002, 0.004, 0.008, 0.0167, 0.033, 0.1}
+
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64 // per bucket, non-cumulative
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// write writes h's series. labels, if not empty, is a label list such as
+// `shard="0"` added to every series.
+func (h *histogram) write(w io.Writer, name, labels string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var cum uint64
+	for i, b := range h.buckets {
+		cum += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%g\"} %d\n", name, labels, sep, b, cum)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n%s_count{%s} %d\n", name, labels, h.sum, name, labels, h.count)
+}
+
+// metrics holds server-wide counters. Gauges such as room and client counts
+// are read from the hub at scrape time instead.
+type metrics struct {
+	roomsCreated     atomic.Int64
+	playersMatched   atomic.Int64
+	clientsRemoved   atomic.Int64
+	matchesCompleted atomic.Int64
+	framesDropped    atomic.Int64
+
+	// Per game loop shard: tick durations, how late the last tick
+	// started, in nanoseconds, and when the last tick finished, in Unix
+	// nanoseconds.
+	tickSeconds  []*histogram
+	tickLag      []atomic.Int64
+	lastTickUnix []atomic.Int64
+}
+
+var serverMetrics = &metrics{}
+
+// initShards sizes the per-shard metrics. It must run before the game loops
+// start.
+func (m *metrics) initShards(n int) {
+	m.tickSeconds = make([]*histogram, n)
+	for i := range m.tickSeconds {
+		m.tickSeconds[i] = newHistogram(tickBuckets)
+	}
+	m.tickLag = make([]atomic.Int64, n)
+	// Count the loops as fresh until their first tick.
+	m.lastTickUnix = make([]atomic.Int64, n)
+	now := time.Now().UnixNano()
+	for i := range m.lastTickUnix {
+		m.lastTickUnix[i].Store(now)
+	}
+}
+
+func (m *metrics) observeTick(shard int, d, lag time.Duration) {
+	m.tickSeconds[shard].observe(d.Seconds())
+	m.tickLag[shard].Store(int64(lag))
+	m.lastTickUnix[shard].Store(time.Now().UnixNano())
+}
+
+// staleShard returns a game loop shard that hasn't finished a tick within
+// loopStaleAfter of now, or -1 if every loop is ticking.
+func (m *metrics) staleShard(now time.Time) int {
+	for i := range m.lastTickUnix {
+		if now.Sub(time.Unix(0, m.lastTickUnix[i].Load())) > loopStaleAfter {
+			return i
+		}
+	}
+	return -1
+}
+
+// gauges returns the current room, client and queue counts.
+func (h *hub) gauges() (rooms, clients, queued int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.rooms), len(h.clients), len(h.waitQ)
+}
+
+func writeMetric(w io.Writer, name, typ, help string, v int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, typ, name, v)
+}
+
+// handleMetrics serves metrics in the Prometheus text exposition format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	rooms, clients, queued := globalHub.gauges()
+	m := serverMetrics
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetric(w, "pong_rooms_active", "gauge", "Rooms currently open.", int64(rooms))
+	writeMetric(w, "pong_clients_connected", "gauge", "Open WebSocket connections.", int64(clients))
+	writeMetric(w, "pong_queue_length", "gauge", "Players waiting in matchmaking.", int64(queued))
+	writeMetric(w, "pong_rooms_created_total", "counter", "Rooms created.", m.roomsCreated.Load())
+	writeMetric(w, "pong_players_matched_total", "counter", "Players paired by matchmaking.", m.playersMatched.Load())
+	writeMetric(w, "pong_clients_removed_total", "counter", "Clients removed from rooms or the queue.", m.clientsRemoved.Load())
+	writeMetric(w, "pong_matches_completed_total", "counter", "Matches that reached gameover.", m.matchesCompleted.Load())
+	writeMetric(w, "pong_frames_dropped_total", "counter", "Frames dropped because a client's send buffer was full.", m.framesDropped.Load())
+
+	const tickName = "pong_tick_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Time spent stepping and broadcasting a shard's rooms per tick.\n# TYPE %s histogram\n", tickName, tickName)
+	for i, h := range m.tickSeconds {
+		h.write(w, tickName, fmt.Sprintf("shard=\"%d\"", i))
+	}
+	const lagName = "pong_tick_lag_seconds"
+	fmt.Fprintf(w, "# HELP %s How late a shard's last tick started.\n# TYPE %s gauge\n", lagName, lagName)
+	for i := range m.tickLag {
+		fmt.Fprintf(w, "%s{shard=\"%d\"} %g\n", lagName, i, time.Duration(m.tickLag[i].Load()).Seconds())
+	}
+}
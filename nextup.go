@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"slices"
+)
+
+var errNotSpectating = errors.New("only spectators can queue to play")
+
+// wsInQueue is the optional payload of "queue". Leave takes the sender out
+// of the queue instead of into it.
+type wsInQueue struct {
+	Leave bool `json:"leave,omitempty"`
+}
+
+// nextUpEntry is one spectator in a room's "next up" queue; their place is
+// their index in the list.
+type nextUpEntry struct {
+	ClientID string `json:"clientId"`
+	Name     string `json:"name"`
+}
+
+// queueToPlay puts spectator c at the back of r's "next up" queue, or takes
+// them out of it with leave. Queued spectators are seated before anyone
+// else when a player slot opens; see promoteSpectatorsLocked.
+func (r *room) queueToPlay(c *client, leave bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if leave {
+		r.unqueueLocked(c)
+		return nil
+	}
+	if r.spectators[c.id] != c {
+		return errNotSpectating
+	}
+	if slices.Contains(r.nextUp, c) {
+		return nil
+	}
+	r.nextUp = append(r.nextUp, c)
+	r.nextUpChangedLocked()
+	return nil
+}
+
+// unqueueLocked takes c out of r's "next up" queue if they're in it. r.mu
+// must be held.
+func (r *room) unqueueLocked(c *client) {
+	if i := slices.Index(r.nextUp, c); i >= 0 {
+		r.nextUp = slices.Delete(r.nextUp, i, i+1)
+		r.nextUpChangedLocked()
+	}
+}
+
+// nextUpChangedLocked sends everyone the queue after it changes. r.mu must
+// be held.
+func (r *room) nextUpChangedLocked() {
+	r.outbox = append(r.outbox, wsOut{Type: "next_up", Data: r.nextUpLocked()})
+}
+
+// nextUpLocked lists r's "next up" queue, front first. r.mu must be held.
+func (r *room) nextUpLocked() []nextUpEntry {
+	q := make([]nextUpEntry, 0, len(r.nextUp))
+	for _, c := range r.nextUp {
+		q = append(q, nextUpEntry{ClientID: c.id, Name: c.displayName()})
+	}
+	return q
+}
+
+// nextUpList is nextUpLocked for callers without r.mu.
+func (r *room) nextUpList() []nextUpEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.nextUpLocked()
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+)
+
+// maxPasswordLen bounds a room password, in bytes.
+const maxPasswordLen = 64
+
+var (
+	errBadPassword  = errors.New("wrong room password")
+	errLongPassword = errors.New("room password too long")
+)
+
+// hashRoomPassword is what a room keeps of its password, salted with the
+// room's id. An empty password leaves the room open and hashes to nil.
+func hashRoomPassword(roomID, password string) []byte {
+	if password == "" {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(roomID + "\x00" + password))
+	return sum[:]
+}
+
+// passwordOKLocked reports whether password admits a client to r. Rooms
+// without a password admit anyone. r.mu must be held.
+func (r *room) passwordOKLocked(password string) bool {
+	if r.passwordHash == nil {
+		return true
+	}
+	return subtle.ConstantTimeCompare(hashRoomPassword(r.id, password), r.passwordHash) == 1
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Power-up tuning. Power-ups only appear in rooms with cfg.powerups set.
+const (
+	powerupRadius   = 16
+	powerupEvery    = 8 * time.Second // between spawns
+	maxPowerups     = 2               // on the field at once
+	powerupDuration = 8 * time.Second // how long paddle effects last
+
+	growFactor   = 1.5 // paddle height for the side that last hit the ball
+	shrinkFactor = 0.6 // paddle height for the other side
+	slowFactor   = 0.6 // ball speed, until the next paddle hit
+)
+
+// powerupKind names a power-up as sent to clients.
+type powerupKind string
+
+const (
+	powerGrow   powerupKind = "grow"
+	powerShrink powerupKind = "shrink"
+	powerSlow   powerupKind = "slow"
+)
+
+var powerupKinds = []powerupKind{powerGrow, powerShrink, powerSlow}
+
+// powerupCodes is the binary encoding of each kind.
+var powerupCodes = map[powerupKind]byte{
+	powerGrow:   0,
+	powerShrink: 1,
+	powerSlow:   2,
+}
+
+// powerup is one pickup waiting on the field.
+type powerup struct {
+	Kind powerupKind `json:"kind"`
+	X    float64     `json:"x"`
+	Y    float64     `json:"y"`
+}
+
+// paddleEffect is a timed change to one side's paddle height. It lasts
+// until the room's tick count reaches until.
+type paddleEffect struct {
+	side   int
+	factor float64
+	until  int
+}
+
+// clearPowerupsLocked removes every pickup and effect, restoring normal
+// paddles. The next spawn is a full interval away.
+func (r *room) clearPowerupsLocked() {
+	r.powerups = nil
+	r.effects = nil
+	r.longestRally = max(r.longestRally, r.rallyHits)
+	r.rallyHits = 0
+	r.paddleLen = [2]float64{r.rules.paddleHeight(0), r.rules.paddleHeight(1)}
+	r.nextPowerup = 0
+}
+
+// ticksFor converts d to a number of ticks at the room's tick rate. Power-up
+// timing runs on ticks so a replay reproduces it.
+func (r *room) ticksFor(d time.Duration) int {
+	return int(d.Seconds() * float64(r.cfg.tickRate))
+}
+
+// stepPowerupsLocked spawns pickups on a timer, applies any the ball passes
+// through, and expires paddle effects.
+func (r *room) stepPowerupsLocked() {
+	if r.nextPowerup == 0 {
+		r.nextPowerup = r.tick + r.ticksFor(powerupEvery)
+	}
+	if r.tick >= r.nextPowerup {
+		if len(r.powerups) < maxPowerups {
+			r.powerups = append(r.powerups, powerup{
+				Kind: powerupKinds[r.rng.IntN(len(powerupKinds))],
+				// Keep clear of the paddles so there's time to react.
+				X: r.cfg.worldW * (0.25 + 0.5*r.rng.Float64()),
+				Y: powerupRadius + (r.cfg.worldH-2*powerupRadius)*r.rng.Float64(),
+			})
+		}
+		r.nextPowerup = r.tick + r.ticksFor(powerupEvery)
+	}
+
+	kept := r.powerups[:0]
+	for _, p := range r.powerups {
+		if b := r.ballAtLocked(p.X, p.Y); b != nil {
+			r.applyPowerupLocked(p.Kind, b)
+			continue
+		}
+		kept = append(kept, p)
+	}
+	r.powerups = kept
+
+	live := r.effects[:0]
+	for _, e := range r.effects {
+		if r.tick < e.until {
+			live = append(live, e)
+		}
+	}
+	if len(live) != len(r.effects) {
+		r.effects = live
+		r.resizePaddlesLocked()
+	}
+}
+
+// ballAtLocked returns a ball touching a pickup at x, y, or nil.
+func (r *room) ballAtLocked(x, y float64) *ball {
+	for i := range r.balls {
+		if math.Hypot(r.balls[i].x-x, r.balls[i].y-y) <= powerupRadius+r.rules.BallRadius {
+			return &r.balls[i]
+		}
+	}
+	return nil
+}
+
+// applyPowerupLocked triggers kind, picked up by b. Paddle effects favor
+// whoever last hit b and do nothing before its first hit of a rally.
+func (r *room) applyPowerupLocked(kind powerupKind, b *ball) {
+	if kind == powerSlow {
+		b.vx *= slowFactor
+		b.vy *= slowFactor
+		return
+	}
+	if b.lastHit < 0 {
+		return
+	}
+	e := paddleEffect{side: b.lastHit, factor: growFactor, until: r.tick + r.ticksFor(powerupDuration)}
+	if kind == powerShrink {
+		e.side, e.factor = 1-b.lastHit, shrinkFactor
+	}
+	r.effects = append(r.effects, e)
+	r.resizePaddlesLocked()
+}
+
+// resizePaddlesLocked recomputes paddle heights from the live effects and
+// the rally's length, keeping each paddle centered where it was and on the
+// field.
+func (r *room) resizePaddlesLocked() {
+	for side := 0; side < 2; side++ {
+		h := r.rules.paddleHeight(side) * r.rallyScaleLocked()
+		for _, e := range r.effects {
+			if e.side == side {
+				h *= e.factor
+			}
+		}
+		h = min(h, r.cfg.worldH)
+		center := r.paddleY[side] + r.paddleLen[side]/2
+		r.paddleLen[side] = h
+		r.paddleY[side] = clamp(center-h/2, 0, r.cfg.worldH-h)
+	}
+}
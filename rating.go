@@ -0,0 +1,122 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Elo parameters. Signed-in players start at initialRating.
+const (
+	initialRating = 1500
+	ratingK       = 32
+)
+
+// Matchmaking window: two rated players are paired if their ratings are
+// within ratingWindow of each other, widened by ratingWindowGrowth for every
+// second the longer-waiting one has been queued.
+const (
+	ratingWindow       = 100
+	ratingWindowGrowth = 20 // per second
+)
+
+// ratingBook holds the Elo rating of every signed-in player seen so far.
+type ratingBook struct {
+	mu      sync.Mutex
+	ratings map[string]float64
+}
+
+func newRatingBook() *ratingBook {
+	return &ratingBook{ratings: make(map[string]float64)}
+}
+
+// get returns userID's rating, or initialRating if they haven't played.
+func (b *ratingBook) get(userID string) float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.getLocked(userID)
+}
+
+func (b *ratingBook) getLocked(userID string) float64 {
+	if r, ok := b.ratings[userID]; ok {
+		return r
+	}
+	return initialRating
+}
+
+// record updates both players' ratings for a finished match. winner is 0, 1
+// or -1 for a draw. Matches with an unrated side don't count.
+func (b *ratingBook) record(userIDs [2]string, winner int) {
+	if userIDs[0] == "" || userIDs[1] == "" || userIDs[0] == userIDs[1] {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	r0, r1 := b.getLocked(userIDs[0]), b.getLocked(userIDs[1])
+	expected := 1 / (1 + math.Pow(10, (r1-r0)/400))
+	actual := 0.5
+	switch winner {
+	case 0:
+		actual = 1
+	case 1:
+		actual = 0
+	}
+	delta := ratingK * (actual - expected)
+	b.ratings[userIDs[0]] = r0 + delta
+	b.ratings[userIDs[1]] = r1 - delta
+}
+
+// replay rebuilds ratings from stored results, oldest first.
+func (b *ratingBook) replay(results []MatchResult) {
+	for _, res := range results {
+		b.record(res.UserIDs, res.Winner)
+	}
+}
+
+// canPairLocked reports whether queued clients a and b, a having waited
+// longer, may play each other at now. Unrated players pair with anyone, as
+// plain FIFO matchmaking did.
+func (h *hub) canPairLocked(a, b *client, now time.Time) (ok bool, gap float64) {
+	if a.userID == "" || b.userID == "" {
+		return true, 0
+	}
+	gap = math.Abs(h.ratings.get(a.userID) - h.ratings.get(b.userID))
+	window := ratingWindow + ratingWindowGrowth*now.Sub(a.queuedAt).Seconds()
+	return gap <= window, gap
+}
+
+// matchLocked pairs queued players, oldest first, each with the acceptable
+// partner closest in rating. Newly paired players are sent their hello,
+// except skip, whose caller sends it. At the room limit pairs stay queued
+// and are told once that they're waiting for a free room. h.mu must be held.
+func (h *hub) matchLocked(now time.Time, skip *client) {
+	for i := 0; i < len(h.waitQ); i++ {
+		a := h.waitQ[i]
+		best, bestGap := -1, math.Inf(1)
+		for j := i + 1; j < len(h.waitQ); j++ {
+			ok, gap := h.canPairLocked(a, h.waitQ[j], now)
+			if ok && gap < bestGap {
+				best, bestGap = j, gap
+			}
+		}
+		if best < 0 {
+			continue
+		}
+		b := h.waitQ[best]
+		if h.fullLocked() {
+			for _, c := range []*client{a, b} {
+				// skip is still owed its hello; the next pass tells it.
+				if c != skip && !c.heldFull {
+					c.heldFull = true
+					sendQueueFull(c)
+				}
+			}
+			continue
+		}
+		h.waitQ = append(h.waitQ[:best], h.waitQ[best+1:]...)
+		h.waitQ = append(h.waitQ[:i], h.waitQ[i+1:]...)
+		i--
+		h.pairLocked(a, b, skip)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import "slices"
+
+// maxRecentMatches caps how many finished matches a room remembers for its
+// scoreboard.
+const maxRecentMatches = 5
+
+// recentMatch is one finished match on a room's scoreboard.
+type recentMatch struct {
+	Players   [2]string `json:"players"`
+	Score     [2]int    `json:"score"` // in the last set
+	Sets      [2]int    `json:"sets"`
+	Winner    int       `json:"winner"` // -1 for a draw
+	Seconds   int       `json:"seconds"`
+	EndReason string    `json:"endReason"`
+}
+
+// recordRecentLocked adds m to the room's scoreboard, dropping the oldest
+// match past maxRecentMatches, and sends everyone the new list. r.mu must
+// be held.
+func (r *room) recordRecentLocked(m recentMatch) {
+	if len(r.recent) == maxRecentMatches {
+		r.recent = slices.Delete(r.recent, 0, 1)
+	}
+	r.recent = append(r.recent, m)
+	r.outbox = append(r.outbox, wsOut{Type: "recent", Data: slices.Clone(r.recent)})
+}
+
+// recentMatches returns the room's scoreboard, oldest first.
+func (r *room) recentMatches() []recentMatch {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.recent)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// maxReplayInputs bounds a match's input recording. A match that goes past
+// it is simply not recorded.
+const maxReplayInputs = 10000
+
+// inputEvent is a change in one side's paddle input, at the match tick where
+// step first saw it.
+type inputEvent struct {
+	Tick   int `json:"tick"`
+	Side   int `json:"side"`
+	Dir    int `json:"dir"`
+	MouseY int `json:"mouseY"` // -1 when steering with the keys
+}
+
+// Replay is what a viewer needs, besides the seed, to re-simulate a match:
+// the settings that shape play, every input change, and the ticks where the
+// match clock ran out, which follow wall time rather than ticks.
+type Replay struct {
+	TickRate   int        `json:"tickRate"`
+	W          float64    `json:"w"`
+	H          float64    `json:"h"`
+	Balls      int        `json:"balls"`
+	Sets       int        `json:"sets"`
+	Powerups   bool       `json:"powerups"`
+	ServeMode  int        `json:"serveMode"`
+	ServeTicks int        `json:"serveTicks"` // ticks each serve is held after a round resets
+	SwapPerSet bool       `json:"swapPerSet"`
+	SwapPoints int        `json:"swapPoints"`
+	Rules      roomConfig `json:"rules"`
+
+	Inputs    []inputEvent `json:"inputs"`
+	ClockEnds []int        `json:"clockEnds"`
+}
+
+// recorder collects a match's inputs as step applies them.
+type recorder struct {
+	// rules are the room's rules as the match started. A side swap moves
+	// the paddle handicap along with the players, so by the end r.rules
+	// may no longer match what a replay has to start from.
+	rules     roomConfig
+	last      [2]inputEvent
+	inputs    []inputEvent
+	clockEnds []int
+}
+
+func newRecorder(rules roomConfig) *recorder {
+	rec := &recorder{rules: rules}
+	for side := 0; side < 2; side++ {
+		rec.last[side] = inputEvent{Side: side, MouseY: -1}
+	}
+	return rec
+}
+
+// recordInputLocked notes side's input for this tick if it changed. Past
+// maxReplayInputs the recording is dropped for the rest of the match.
+func (r *room) recordInputLocked(side, dir, mouseY int) {
+	rec := r.rec
+	if rec == nil {
+		return
+	}
+	if last := rec.last[side]; last.Dir == dir && last.MouseY == mouseY {
+		return
+	}
+	if len(rec.inputs) >= maxReplayInputs {
+		r.rec = nil
+		return
+	}
+	ev := inputEvent{Tick: r.tick, Side: side, Dir: dir, MouseY: mouseY}
+	rec.last[side] = ev
+	rec.inputs = append(rec.inputs, ev)
+}
+
+// recordClockEndLocked notes that the match clock ran out on this tick.
+func (r *room) recordClockEndLocked() {
+	if r.rec != nil {
+		r.rec.clockEnds = append(r.rec.clockEnds, r.tick)
+	}
+}
+
+// replayLocked packages the recording, or returns nil if there is none.
+func (r *room) replayLocked() *Replay {
+	if r.rec == nil {
+		return nil
+	}
+	return &Replay{
+		TickRate:   r.cfg.tickRate,
+		W:          r.cfg.worldW,
+		H:          r.cfg.worldH,
+		Balls:      r.cfg.balls,
+		Sets:       r.cfg.sets,
+		Powerups:   r.cfg.powerups,
+		ServeMode:  int(r.serveMode),
+		ServeTicks: r.serveTicksLocked(),
+		SwapPerSet: r.cfg.swapPerSet,
+		SwapPoints: r.cfg.swapPoints,
+		Rules:      r.rec.rules,
+		Inputs:     r.rec.inputs,
+		ClockEnds:  r.rec.clockEnds,
+	}
+}
+
+// handleReplay serves the most recent recorded match played in a room.
+func handleReplay(w http.ResponseWriter, r *http.Request) {
+	results, err := globalHub.results.All()
+	if err != nil {
+		log.Printf("replay: %v", err)
+		http.Error(w, "replays unavailable", http.StatusInternalServerError)
+		return
+	}
+	id := r.PathValue("roomId")
+	for i := len(results) - 1; i >= 0; i-- {
+		if res := results[i]; res.RoomID == id && res.Replay != nil {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(res)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
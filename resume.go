@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// resumeGrace is how long a disconnected player's slot is held open for a
+// "resume" before they are removed from the room.
+const resumeGrace = 15 * time.Second
+
+// watchResumeTTL is how long a dropped spectator's resume token leads back
+// to the room they were watching.
+const watchResumeTTL = 10 * time.Minute
+
+// watchMark records where a dropped spectator was watching from.
+type watchMark struct {
+	roomID string
+	name   string
+	color  string
+	until  time.Time
+}
+
+var (
+	errResumeFailed = errors.New("resume failed")
+	errRoomGone     = errors.New("room closed")
+)
+
+type wsInResume struct {
+	Token string `json:"token"`
+}
+
+func newResumeToken() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// disconnect is called when c's connection goes away. Players in a live match
+// keep their slot for resumeGrace; everyone else is removed immediately.
+func (h *hub) disconnect(c *client) {
+	if h.suspend(c) {
+		return
+	}
+	h.markWatching(c)
+	h.removeClient(c)
+}
+
+// markWatching lets a spectator who is about to be removed come back to the
+// same room with "resume_spectate" and their token.
+func (h *hub) markWatching(c *client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	r, side := c.seat()
+	if r == nil || side >= 0 || c.token == "" {
+		return
+	}
+	now := time.Now()
+	for token, m := range h.watching {
+		if now.After(m.until) {
+			delete(h.watching, token)
+		}
+	}
+	name, color := c.profile()
+	h.watching[c.token] = watchMark{
+		roomID: r.id,
+		name:   name,
+		color:  color,
+		until:  now.Add(watchResumeTTL),
+	}
+}
+
+// resumeSpectate seats c as a spectator of the room the dropped spectator
+// with token was watching, keeping their token, name and color. If that room
+// has closed, c leaves matchmaking too and the error is errRoomGone.
+func (h *hub) resumeSpectate(c *client, token string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	m, ok := h.watching[token]
+	if !ok || time.Now().After(m.until) {
+		return errResumeFailed
+	}
+	r := h.rooms[m.roomID]
+	if r == nil {
+		delete(h.watching, token)
+		h.dequeueLocked(c)
+		return errRoomGone
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.spectators) >= r.cfg.maxSpectators {
+		return errRoomFull
+	}
+	delete(h.watching, token)
+	c.token = token
+	c.seatMu.Lock()
+	if c.userID == "" {
+		c.name = m.name
+	}
+	c.color = m.color
+	c.seatMu.Unlock()
+	h.addSpectatorLocked(r, c)
+	return nil
+}
+
+// suspend holds c's player slot open and pauses the match until c resumes or
+// the grace window runs out.
+func (h *hub) suspend(c *client) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	r, side := c.seat()
+	if r == nil || side < 0 || c.token == "" {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// A swap can move c before r.mu is taken.
+	_, side = c.seat()
+	if r.players[side] != c || r.phase == phaseFinished || !r.filledLocked(1-side) {
+		return false
+	}
+
+	// Hold the paddle where it is.
+	c.moveDir.Store(0)
+	c.mouseY.Store(mouseUnused)
+
+	r.away[side] = true
+	if r.pausedAt.IsZero() {
+		r.pausedAt = r.clock()
+	}
+	h.resumable[c.token] = c
+	r.graceTimer[side] = time.AfterFunc(resumeGrace, func() { h.expire(c) })
+	return true
+}
+
+// expire frees a suspended player's slot once the grace window has passed
+// without a resume.
+func (h *hub) expire(c *client) {
+	h.mu.Lock()
+	if h.resumable[c.token] != c {
+		// Already resumed.
+		h.mu.Unlock()
+		return
+	}
+	delete(h.resumable, c.token)
+	h.mu.Unlock()
+
+	h.removeClient(c)
+}
+
+// resume moves the fresh connection c into the slot held for token. c takes
+// over the suspended client's identity.
+func (h *hub) resume(c *client, token string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	old := h.resumable[token]
+	if old == nil {
+		return false
+	}
+	r := old.room
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	side := old.side
+	if r.players[side] != old {
+		return false
+	}
+	// A signed-in connection can only take back its own slot.
+	if c.userID != "" && c.userID != old.userID {
+		return false
+	}
+
+	// Only a valid claim uses up the token, so a rejected one leaves the
+	// slot held for its owner and for expire.
+	delete(h.resumable, token)
+	h.dequeueLocked(c)
+	if t := r.graceTimer[side]; t != nil {
+		t.Stop()
+		r.graceTimer[side] = nil
+	}
+
+	name, _ := old.profile()
+	c.seatMu.Lock()
+	c.id, c.name, c.userID, c.token = old.id, name, old.userID, old.token
+	c.seatMu.Unlock()
+	c.setSeat(r, side)
+	r.players[side] = c
+	r.away[side] = false
+	r.touch()
+	r.resumeClockLocked()
+	return true
+}
+
+// resumeClockLocked restarts the match clock once no player is away or
+// stalled, pushing the end time back by however long the match was paused.
+func (r *room) resumeClockLocked() {
+	if r.away[0] || r.away[1] || r.phase == phasePaused || r.pausedAt.IsZero() {
+		return
+	}
+	if !r.endTime.IsZero() {
+		r.endTime = r.endTime.Add(r.clock().Sub(r.pausedAt))
+	}
+	r.pausedAt = time.Time{}
+	r.activeSince = r.clock()
+}
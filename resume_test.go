@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestResumeRejectedKeepsToken(t *testing.T) {
+	h := newHub(defaultConfig(), &memoryStore{})
+	h.mu.Lock()
+	r := h.newRoomLocked()
+	h.mu.Unlock()
+	a := &client{id: "a", userID: "alice", token: "tok-a", room: r, side: 0}
+	b := &client{id: "b", userID: "bob", token: "tok-b", room: r, side: 1}
+	r.players = [2]*client{a, b}
+
+	if !h.suspend(a) {
+		t.Fatal("suspend failed")
+	}
+	defer r.graceTimer[0].Stop()
+
+	intruder := &client{id: "x", userID: "mallory", side: -1}
+	if h.resume(intruder, a.token) {
+		t.Fatal("another user resumed alice's slot")
+	}
+	if h.resumable[a.token] != a || !r.away[0] || r.graceTimer[0] == nil {
+		t.Fatal("rejected resume released alice's hold")
+	}
+
+	back := &client{id: "a2", userID: "alice", side: -1}
+	if !h.resume(back, a.token) {
+		t.Fatal("alice couldn't resume after the rejected attempt")
+	}
+	if r.players[0] != back || r.away[0] {
+		t.Errorf("players[0] = %v, away %v; want alice back in play", r.players[0], r.away[0])
+	}
+}
+
+// readHello reads conn's messages up to the next hello.
+func readHello(t *testing.T, conn *websocket.Conn) wsOutHello {
+	t.Helper()
+	for {
+		var msg struct {
+			Type string     `json:"type"`
+			Data wsOutHello `json:"data"`
+		}
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == "hello" {
+			return msg.Data
+		}
+	}
+}
+
+func TestResumeOnURLSkipsMatchmaking(t *testing.T) {
+	h, url := startServer(t, defaultConfig())
+	a := dialWS(t, url)
+	waitFor(t, "a to queue", func() bool {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return len(h.waitQ) == 1
+	})
+	dialWS(t, url)
+	hello := readHello(t, a)
+	for hello.Side != 0 {
+		hello = readHello(t, a)
+	}
+
+	// a drops mid-match and is held for resume.
+	a.Close()
+	waitFor(t, "a's slot to be held", func() bool {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return h.resumable[hello.Token] != nil
+	})
+
+	// Someone else is waiting for a match when a comes back.
+	dialWS(t, url)
+	waitFor(t, "the newcomer to queue", func() bool {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return len(h.waitQ) == 1
+	})
+	back := readHello(t, dialWS(t, url+"?resume="+hello.Token))
+	if back.RoomID != hello.RoomID || back.Side != 0 {
+		t.Fatalf("resumed into %q side %d, want %q side 0", back.RoomID, back.Side, hello.RoomID)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.waitQ) != 1 {
+		t.Errorf("%d queued after the resume, want the newcomer still waiting", len(h.waitQ))
+	}
+}
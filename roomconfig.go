@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// roomConfig is a room's paddle and ball tuning. Matchmade rooms use the
+// defaults; a private room's creator can change them.
+type roomConfig struct {
+	PaddleW      float64 `json:"paddleW"`
+	PaddleH      float64 `json:"paddleH"`
+	PaddleSpeed  float64 `json:"paddleSpeed"` // px/s
+	BallRadius   float64 `json:"ballRadius"`
+	BallSpeed    float64 `json:"ballSpeed"` // serve speed, px/s
+	MaxBallSpeed float64 `json:"maxBallSpeed"`
+	// SpeedRamp multiplies the ball's speed on each paddle hit, up to
+	// MaxBallSpeed; 1 keeps it constant. Zero counts as the default, for
+	// rules recorded before it existed.
+	SpeedRamp float64 `json:"speedRamp"`
+	// ServeAngle and BounceAngle are the steepest, in radians from the
+	// horizontal, that a serve and a paddle hit send the ball. Zero counts
+	// as the default, as for SpeedRamp.
+	ServeAngle  float64 `json:"serveAngle"`
+	BounceAngle float64 `json:"bounceAngle"`
+	// PaddleScale handicaps a match by scaling each side's paddle height.
+	// Zero counts as 1, for rules recorded before it existed.
+	PaddleScale [2]float64 `json:"paddleScale"`
+	// Shrink makes paddles smaller the longer a rally runs; see
+	// rallyScaleLocked.
+	Shrink bool `json:"shrink,omitempty"`
+}
+
+func defaultRoomConfig() roomConfig {
+	return roomConfig{
+		PaddleW:      paddleW,
+		PaddleH:      paddleH,
+		PaddleSpeed:  paddleSpeedPxS,
+		BallRadius:   ballRadius,
+		BallSpeed:    ballBaseSpeed,
+		MaxBallSpeed: maxBallSpeed,
+		SpeedRamp:    defaultSpeedRamp,
+		ServeAngle:   defaultServeAngle,
+		BounceAngle:  defaultBounceAngle,
+		PaddleScale:  [2]float64{1, 1},
+	}
+}
+
+// paddleHeight is side's full paddle height under rc.
+func (rc roomConfig) paddleHeight(side int) float64 {
+	scale := rc.PaddleScale[side]
+	if scale == 0 {
+		scale = 1
+	}
+	return rc.PaddleH * scale
+}
+
+// speedRamp is rc's per-hit speed multiplier.
+func (rc roomConfig) speedRamp() float64 {
+	if rc.SpeedRamp == 0 {
+		return defaultSpeedRamp
+	}
+	return rc.SpeedRamp
+}
+
+// serveAngle is the steepest angle rc serves at.
+func (rc roomConfig) serveAngle() float64 {
+	if rc.ServeAngle == 0 {
+		return defaultServeAngle
+	}
+	return rc.ServeAngle
+}
+
+// bounceAngle is the steepest angle a paddle hit sends the ball at under
+// rc.
+func (rc roomConfig) bounceAngle() float64 {
+	if rc.BounceAngle == 0 {
+		return defaultBounceAngle
+	}
+	return rc.BounceAngle
+}
+
+// wsInCreate is the optional payload of "create". Zero fields keep their
+// defaults.
+type wsInCreate struct {
+	roomConfig
+	// Side is the creator's preferred side, for "create" only; see
+	// preferredSide.
+	Side *int `json:"side,omitempty"`
+	// Password, if set, locks the room; see wsInJoin.
+	Password string `json:"password,omitempty"`
+}
+
+// customRange bounds each custom setting.
+var customRange = map[string][2]float64{
+	"paddleW":      {4, 40},
+	"paddleH":      {20, 400},
+	"paddleSpeed":  {100, 2000},
+	"ballRadius":   {3, 30},
+	"ballSpeed":    {100, 1500},
+	"maxBallSpeed": {100, 3000},
+	"paddleScale":  {0.5, 2},
+	"speedRamp":    {1, 1.2},
+	// Angles are in radians and stay well short of vertical, where the
+	// ball would only bounce between the walls.
+	"serveAngle":  {0.05, 1},
+	"bounceAngle": {0.2, 1.3},
+}
+
+// rules applies m's overrides to the defaults and checks the result fits
+// cfg's world.
+func (m wsInCreate) rules(cfg config) (roomConfig, error) {
+	rc := defaultRoomConfig()
+	for _, f := range []struct {
+		name string
+		in   float64
+		out  *float64
+	}{
+		{"paddleW", m.PaddleW, &rc.PaddleW},
+		{"paddleH", m.PaddleH, &rc.PaddleH},
+		{"paddleSpeed", m.PaddleSpeed, &rc.PaddleSpeed},
+		{"ballRadius", m.BallRadius, &rc.BallRadius},
+		{"ballSpeed", m.BallSpeed, &rc.BallSpeed},
+		{"maxBallSpeed", m.MaxBallSpeed, &rc.MaxBallSpeed},
+		{"speedRamp", m.SpeedRamp, &rc.SpeedRamp},
+		{"serveAngle", m.ServeAngle, &rc.ServeAngle},
+		{"bounceAngle", m.BounceAngle, &rc.BounceAngle},
+		{"paddleScale", m.PaddleScale[0], &rc.PaddleScale[0]},
+		{"paddleScale", m.PaddleScale[1], &rc.PaddleScale[1]},
+	} {
+		if f.in == 0 {
+			continue
+		}
+		lim := customRange[f.name]
+		if f.in < lim[0] || f.in > lim[1] {
+			return rc, fmt.Errorf("%s must be between %g and %g", f.name, lim[0], lim[1])
+		}
+		*f.out = f.in
+	}
+	rc.Shrink = m.Shrink
+	if rc.MaxBallSpeed < rc.BallSpeed {
+		return rc, errors.New("maxBallSpeed must be at least ballSpeed")
+	}
+	if max(rc.paddleHeight(0), rc.paddleHeight(1)) >= cfg.worldH || 2*(paddleMargin+rc.PaddleW)+4*rc.BallRadius > cfg.worldW {
+		return rc, errors.New("paddles and ball don't fit the field")
+	}
+	return rc, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"math/rand/v2"
+	"sort"
+	"time"
+)
+
+// simulation runs a room headlessly: no network, a virtual clock that moves
+// one tick per step, and a fixed seed, so the same inputs always give the
+// same match. It drives the same step as the game loop.
+type simulation struct {
+	room *room
+	now  time.Time
+}
+
+// simEpoch is where a simulation's virtual clock starts.
+var simEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// newSimulation seats two headless players, both ready, in a room with the
+// given tuning and seed.
+func newSimulation(cfg config, rules roomConfig, seed uint64) *simulation {
+	s := &simulation{room: newRoom(0, cfg), now: simEpoch}
+	r := s.room
+	r.clock = func() time.Time { return s.now }
+	r.rules = rules
+	r.seed = seed
+	r.rng = rand.New(rand.NewPCG(seed, seed))
+	r.clearPowerupsLocked()
+	r.centerLocked()
+	for side := 0; side < 2; side++ {
+		c := &client{id: "sim-" + itoa(side), side: side}
+		c.mouseY.Store(mouseUnused)
+		r.players[side] = c
+		r.ready[side] = true
+	}
+	return s
+}
+
+// simulate advances the match by ticks steps, applying each input when
+// step reaches its tick, as a replay's inputs were recorded. Ticks count from
+// the first serve, so inputs wait out the countdown.
+func (s *simulation) simulate(inputs []inputEvent, ticks int) {
+	inputs = append([]inputEvent(nil), inputs...)
+	sort.SliceStable(inputs, func(i, j int) bool { return inputs[i].Tick < inputs[j].Tick })
+	dt := 1.0 / float64(s.room.cfg.tickRate)
+	tick := time.Second / time.Duration(s.room.cfg.tickRate)
+
+	for n := 0; n < ticks; n++ {
+		s.now = s.now.Add(tick)
+		if !s.room.startTime.IsZero() {
+			for len(inputs) > 0 && inputs[0].Tick <= s.room.tick+1 {
+				s.apply(inputs[0])
+				inputs = inputs[1:]
+			}
+		}
+		s.room.step(dt)
+		s.room.takeOutbox()
+		s.room.takeRehello()
+		s.room.takeKicked()
+	}
+}
+
+// apply sets a headless player's input as readPump would. Sides are as of
+// the event, so inputs follow players who have changed ends.
+func (s *simulation) apply(ev inputEvent) {
+	c := s.room.players[ev.Side]
+	c.moveDir.Store(int32(ev.Dir))
+	if ev.MouseY < 0 {
+		c.mouseY.Store(mouseUnused)
+	} else {
+		c.mouseY.Store(int32(ev.MouseY))
+	}
+	c.lastMove.Store(s.now.UnixNano())
+}
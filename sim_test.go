@@ -0,0 +1,281 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// playing returns a simulation with default tuning whose first serve is in
+// flight, so tests can place the ball and step from there.
+func playing(t *testing.T, rules roomConfig) *simulation {
+	t.Helper()
+	s := newSimulation(defaultConfig(), rules, 1)
+	for n := 0; s.room.phase != phasePlaying || s.room.serveTicks > 0; n++ {
+		if n > 10*s.room.cfg.tickRate {
+			t.Fatalf("match never started: phase %s", s.room.phase)
+		}
+		s.simulate(nil, 1)
+	}
+	return s
+}
+
+// place puts the only ball at (x, y) moving at (vx, vy).
+func (s *simulation) place(x, y, vx, vy float64) *ball {
+	b := &s.room.balls[0]
+	b.x, b.y, b.vx, b.vy = x, y, vx, vy
+	b.lastHit = -1
+	return b
+}
+
+func TestSimulationScores(t *testing.T) {
+	s := playing(t, defaultRoomConfig())
+	r := s.room
+	// Left paddle at the top, ball heading for the bottom of its goal.
+	r.paddleY[0] = 0
+	s.place(60, r.cfg.worldH-40, -600, 0)
+
+	s.simulate(nil, 10)
+	if r.score != [2]int{0, 1} {
+		t.Fatalf("score = %v, want [0 1]", r.score)
+	}
+}
+
+func TestSimulationServesAfterPoint(t *testing.T) {
+	s := playing(t, defaultRoomConfig())
+	r := s.room
+	r.paddleY[0] = 0
+	s.place(60, r.cfg.worldH-40, -600, 0)
+	for n := 0; r.score == ([2]int{}); n++ {
+		if n > r.cfg.tickRate {
+			t.Fatal("no point scored")
+		}
+		s.simulate(nil, 1)
+	}
+
+	// Loser serve mode: the ball is held on the center line, then goes
+	// back toward the side that conceded.
+	b := r.balls[0]
+	if b.x != r.cfg.worldW/2 || r.serveTicks == 0 {
+		t.Errorf("after the point: x = %g, serveTicks = %d, want held at the center", b.x, r.serveTicks)
+	}
+	if b.vx >= 0 {
+		t.Errorf("serve vx = %g, want toward the left player", b.vx)
+	}
+}
+
+func TestSimulationWallBounces(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		y    float64
+		vy   float64
+	}{
+		{"top", 12, -300},
+		{"bottom", defaultWorldH - 12, 300},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := playing(t, defaultRoomConfig())
+			r := s.room
+			b := s.place(r.cfg.worldW/2, tc.y, 100, tc.vy)
+			s.simulate(nil, 1)
+			if math.Signbit(b.vy) == math.Signbit(tc.vy) {
+				t.Errorf("vy = %g after hitting the %s wall, want it reversed", b.vy, tc.name)
+			}
+			if b.y < r.rules.BallRadius || b.y > r.cfg.worldH-r.rules.BallRadius {
+				t.Errorf("ball at y = %g, outside the field", b.y)
+			}
+		})
+	}
+}
+
+func TestSimulationPaddleBounces(t *testing.T) {
+	for side := 0; side < 2; side++ {
+		s := playing(t, defaultRoomConfig())
+		r := s.room
+		center := r.paddleY[side] + r.paddleLen[side]/2
+		x, vx := float64(paddleMargin+paddleW)+r.rules.BallRadius+3, -300.0
+		if side == 1 {
+			x, vx = r.cfg.worldW-x, 300
+		}
+		b := s.place(x, center, vx, 0)
+		s.simulate(nil, 1)
+		if math.Signbit(b.vx) == math.Signbit(vx) {
+			t.Errorf("side %d: vx = %g, want it reversed by the paddle", side, b.vx)
+		}
+		if b.lastHit != side || r.rallyHits != 1 {
+			t.Errorf("side %d: lastHit %d, rallyHits %d, want %d and 1", side, b.lastHit, r.rallyHits, side)
+		}
+	}
+}
+
+func TestSimulationDeterministic(t *testing.T) {
+	inputs := []inputEvent{
+		{Tick: 1, Side: 0, Dir: 1, MouseY: -1},
+		{Tick: 30, Side: 1, Dir: 0, MouseY: 100},
+		{Tick: 90, Side: 0, Dir: -1, MouseY: -1},
+	}
+	run := func() *room {
+		s := newSimulation(defaultConfig(), defaultRoomConfig(), 42)
+		s.simulate(inputs, 30*s.room.cfg.tickRate)
+		return s.room
+	}
+	a, b := run(), run()
+	if a.score != b.score || a.balls[0] != b.balls[0] || a.paddleY != b.paddleY {
+		t.Errorf("same seed and inputs diverged: %v %+v %v vs %v %+v %v",
+			a.score, a.balls[0], a.paddleY, b.score, b.balls[0], b.paddleY)
+	}
+}
+
+// hitPaddle sends the ball into side's paddle face with speed toward the
+// paddle and vertical velocity vy, aimed to cross the face at y, and steps
+// once, returning the ball.
+func hitPaddle(s *simulation, side int, y, speed, vy float64) *ball {
+	r := s.room
+	const gap = 2 // between the ball's edge and the face before the step
+	x, vx := float64(paddleMargin+paddleW)+r.rules.BallRadius+gap, -speed
+	if side == 1 {
+		x, vx = r.cfg.worldW-x, speed
+	}
+	b := s.place(x, y-gap*vy/speed, vx, vy)
+	s.simulate(nil, 1)
+	return b
+}
+
+func TestBounceCarriesIncomingSlope(t *testing.T) {
+	for side := 0; side < 2; side++ {
+		s := playing(t, defaultRoomConfig())
+		r := s.room
+		center := r.paddleY[side] + r.paddleLen[side]/2
+		// Steeply down onto the middle of the paddle: the spin alone
+		// would send it back nearly flat.
+		b := hitPaddle(s, side, center, 300, 500)
+		if b.lastHit != side {
+			t.Fatalf("side %d: ball missed the paddle", side)
+		}
+		if b.vy <= 0 {
+			t.Errorf("side %d: vy = %g after a downward center hit, want some downward slope kept", side, b.vy)
+		}
+		speed := math.Hypot(b.vx, b.vy)
+		if speed < r.rules.BallSpeed || speed > r.rules.MaxBallSpeed {
+			t.Errorf("side %d: speed %g outside [%g, %g]", side, speed, r.rules.BallSpeed, r.rules.MaxBallSpeed)
+		}
+	}
+}
+
+func TestHandicapPaddleHeight(t *testing.T) {
+	rules := defaultRoomConfig()
+	rules.PaddleScale = [2]float64{1, 2}
+	for side, wantHit := range []bool{false, true} {
+		s := playing(t, rules)
+		r := s.room
+		if r.paddleLen[side] != rules.paddleHeight(side) {
+			t.Fatalf("side %d: paddle %g tall, want %g", side, r.paddleLen[side], rules.paddleHeight(side))
+		}
+		// Past the end of a normal paddle, within a doubled one.
+		y := r.paddleY[side] + r.paddleLen[side]/2 + 0.75*paddleH
+		b := hitPaddle(s, side, y, 300, 0)
+		if hit := b.lastHit == side; hit != wantHit {
+			t.Errorf("side %d (scale %g): hit = %v, want %v", side, rules.PaddleScale[side], hit, wantHit)
+		}
+	}
+}
+
+func TestMouseDeadZone(t *testing.T) {
+	s := playing(t, defaultRoomConfig())
+	r := s.room
+	p := r.players[0]
+	start := r.paddleY[0]
+	center := int32(start + r.paddleLen[0]/2)
+
+	// Jitter around the paddle's center, within the dead zone.
+	for i, dy := range []int32{2, -2, 1, -3, 3, 0} {
+		p.mouseY.Store(center + dy)
+		s.simulate(nil, 1)
+		if r.paddleY[0] != start {
+			t.Fatalf("jitter %d (%+d px): paddle moved from %g to %g", i, dy, start, r.paddleY[0])
+		}
+	}
+
+	p.mouseY.Store(center + 4*mouseDeadZone)
+	s.simulate(nil, 1)
+	if r.paddleY[0] <= start {
+		t.Errorf("paddle stayed at %g for a move past the dead zone", r.paddleY[0])
+	}
+}
+
+func TestLongestRallyCountsUnfinishedRally(t *testing.T) {
+	s := playing(t, defaultRoomConfig())
+	r := s.room
+	// The match ends mid-rally, with no point to close it.
+	r.rallyHits = 9
+	r.outbox = nil
+	r.finishAsLocked("time", 0)
+	if r.longestRally != 9 {
+		t.Errorf("longestRally = %d, want the unfinished rally's 9", r.longestRally)
+	}
+	for _, m := range r.outbox {
+		if over, ok := m.Data.(wsOutGameOver); ok && over.LongestRally != 9 {
+			t.Errorf("gameover reports longestRally %d, want 9", over.LongestRally)
+		}
+	}
+}
+
+func TestStallPausesByTime(t *testing.T) {
+	s := playing(t, defaultRoomConfig())
+	r := s.room
+	p := r.players[0]
+	p.send = make(chan outFrame, 1)
+	p.trySend([]byte("backlog"))
+
+	// The first dropped frame starts the clock.
+	p.trySend([]byte("dropped"))
+	start := time.Unix(0, p.dropSince.Load())
+	if r.checkStallLocked(start.Add(stallAfter/2)) || r.phase != phasePlaying {
+		t.Fatalf("paused %s into a backlog, before stallAfter", stallAfter/2)
+	}
+	if !r.checkStallLocked(start.Add(stallAfter)) || r.phase != phasePaused {
+		t.Fatalf("phase %s after %s of drops, want paused", r.phase, stallAfter)
+	}
+
+	<-p.send
+	if !p.trySend([]byte("through")) {
+		t.Fatal("send failed after draining")
+	}
+	if r.checkStallLocked(start.Add(2*stallAfter)) || r.phase != phasePlaying {
+		t.Errorf("phase %s once frames get through, want playing", r.phase)
+	}
+}
+
+func TestReplayKeepsStartingHandicap(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.recordInputs = true
+	cfg.swapPoints = 1
+	rules := defaultRoomConfig()
+	rules.PaddleScale = [2]float64{1, 1.5}
+	s := newSimulation(cfg, rules, 1)
+	r := s.room
+	for n := 0; r.phase != phasePlaying || r.serveTicks > 0; n++ {
+		if n > 10*cfg.tickRate {
+			t.Fatalf("match never started: phase %s", r.phase)
+		}
+		s.simulate(nil, 1)
+	}
+	r.paddleY[0] = 0
+	s.place(60, cfg.worldH-40, -600, 0)
+	for n := 0; r.score == ([2]int{}); n++ {
+		if n > cfg.tickRate {
+			t.Fatal("no point scored")
+		}
+		s.simulate(nil, 1)
+	}
+	if r.rules.PaddleScale != [2]float64{1.5, 1} {
+		t.Fatalf("after the swap, paddleScale = %v, want the handicap moved along", r.rules.PaddleScale)
+	}
+	rep := r.replayLocked()
+	if rep == nil {
+		t.Fatal("no replay recorded")
+	}
+	if rep.Rules.PaddleScale != rules.PaddleScale {
+		t.Errorf("replay paddleScale = %v, want %v as the match started", rep.Rules.PaddleScale, rules.PaddleScale)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import "time"
+
+// A player whose send buffer has dropped every frame for stallAfter, at any
+// broadcast rate, pauses the match. If it hasn't drained after stallTimeout
+// they forfeit.
+const (
+	stallAfter   = 500 * time.Millisecond
+	stallTimeout = 10 * time.Second
+)
+
+type wsOutPaused struct {
+	Reason string `json:"reason"`
+	Side   int    `json:"side"`
+}
+
+// stalledSideLocked returns a player whose connection is stalled at now, or
+// -1.
+func (r *room) stalledSideLocked(now time.Time) int {
+	for side := 0; side < 2; side++ {
+		p := r.players[side]
+		if p == nil {
+			continue
+		}
+		if since := p.dropSince.Load(); since != 0 && now.Sub(time.Unix(0, since)) >= stallAfter {
+			return side
+		}
+	}
+	return -1
+}
+
+// checkStallLocked pauses a match in play when a player stalls, and resumes
+// it once their backlog clears. It reports true while step should hold the
+// game still.
+func (r *room) checkStallLocked(now time.Time) bool {
+	stalled := r.stalledSideLocked(now)
+	switch r.phase {
+	case phasePlaying:
+		if stalled < 0 {
+			return false
+		}
+		r.phase = phasePaused
+		r.stalledSince = now
+		if r.pausedAt.IsZero() {
+			r.pausedAt = now
+		}
+		r.outbox = append(r.outbox, wsOut{Type: "paused", Data: wsOutPaused{Reason: "stalled", Side: stalled}})
+		return true
+	case phasePaused:
+		if stalled < 0 {
+			r.unpauseLocked()
+			r.outbox = append(r.outbox, wsOut{Type: "resumed"})
+			return false
+		}
+		if now.Sub(r.stalledSince) >= stallTimeout {
+			r.finishAsLocked("stalled", 1-stalled)
+		}
+		return true
+	}
+	return false
+}
+
+// unpauseLocked returns a stall-paused match to play and restarts its clock.
+func (r *room) unpauseLocked() {
+	if r.phase != phasePaused {
+		return
+	}
+	r.phase = phasePlaying
+	r.stalledSince = time.Time{}
+	r.resumeClockLocked()
+}
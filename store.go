@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MatchResult is the record of one finished match.
+type MatchResult struct {
+	RoomID    string    `json:"roomId"`
+	Players   [2]string `json:"players"`
+	UserIDs   [2]string `json:"userIds"` // empty for anonymous players
+	Score     [2]int    `json:"score"`   // of the final set
+	Sets      [2]int    `json:"sets"`
+	Winner    int       `json:"winner"` // 0 left, 1 right, -1 draw
+	Seed      uint64    `json:"seed"`   // the room's RNG seed for this match
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	EndReason string    `json:"endReason"`
+	Replay    *Replay   `json:"replay,omitempty"` // only when inputs were recorded
+	// Timeline samples the score through the match, for momentum graphs.
+	Timeline     []scoreSample `json:"timeline,omitempty"`
+	LongestRally int           `json:"longestRally"` // most paddle hits in one rally
+}
+
+// ResultStore persists finished matches. Record may block, so rooms call it
+// from their own goroutine rather than the game loop.
+type ResultStore interface {
+	Record(MatchResult)
+	// All returns every stored result, oldest first.
+	All() ([]MatchResult, error)
+}
+
+// maxMemoryResults bounds the in-memory store; the oldest results are
+// dropped first.
+const maxMemoryResults = 10000
+
+// memoryStore keeps results in process memory. It is the default.
+type memoryStore struct {
+	mu      sync.Mutex
+	results []MatchResult
+}
+
+func (s *memoryStore) Record(res MatchResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.results) >= maxMemoryResults {
+		s.results = append(s.results[:0], s.results[1:]...)
+	}
+	s.results = append(s.results, res)
+}
+
+func (s *memoryStore) All() ([]MatchResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]MatchResult(nil), s.results...), nil
+}
+
+// fileStore appends results to a file as JSON lines.
+type fileStore struct {
+	mu sync.Mutex
+	f  *os.File
+	// results mirrors the file, read once when it is opened, so All
+	// needn't parse it again.
+	results []MatchResult
+}
+
+func newFileStore(path string) (*fileStore, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	s := &fileStore{f: f}
+	if err := s.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads the results already in the file. Lines that don't parse, such
+// as one torn by a crash mid-write, are skipped rather than failing every
+// later read, and a torn last line is ended so the next record starts
+// fresh.
+func (s *fileStore) load() error {
+	r := bufio.NewReader(s.f)
+	skipped := 0
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] != '\n' {
+			if _, err := s.f.Write([]byte{'\n'}); err != nil {
+				return err
+			}
+		}
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			var res MatchResult
+			if json.Unmarshal(line, &res) != nil {
+				skipped++
+			} else {
+				s.results = append(s.results, res)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if skipped > 0 {
+		log.Printf("results: skipped %d unreadable lines in %s", skipped, s.f.Name())
+	}
+	return nil
+}
+
+func (s *fileStore) Record(res MatchResult) {
+	b, err := json.Marshal(res)
+	if err != nil {
+		log.Printf("results: %v", err)
+		return
+	}
+	b = append(b, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.f.Write(b); err != nil {
+		log.Printf("results: %v", err)
+		return
+	}
+	s.results = append(s.results, res)
+}
+
+// newResultStore picks the store for cfg: a JSON-lines file if a results
+// file is configured, memory otherwise.
+func newResultStore(cfg config) (ResultStore, error) {
+	if cfg.resultsFile == "" {
+		return &memoryStore{}, nil
+	}
+	return newFileStore(cfg.resultsFile)
+}
+
+func (s *fileStore) All() ([]MatchResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]MatchResult(nil), s.results...), nil
+}
+
+// leaderboardSize is how many names /stats lists.
+const leaderboardSize = 10
+
+type leaderboardEntry struct {
+	UserID string `json:"userId,omitempty"`
+	Name   string `json:"name"`
+	Wins   int    `json:"wins"`
+}
+
+// matchStats is the aggregate served by GET /stats.
+type matchStats struct {
+	Matches     int                `json:"matches"`
+	AvgSeconds  float64            `json:"avgSeconds"`
+	Leaderboard []leaderboardEntry `json:"leaderboard"`
+}
+
+// summarize aggregates results into match count, average length and the
+// players with the most wins. Signed-in players are ranked by user id under
+// their latest name; anonymous ones by name. The practice bot isn't ranked.
+func summarize(results []MatchResult) matchStats {
+	stats := matchStats{Matches: len(results), Leaderboard: []leaderboardEntry{}}
+	if len(results) == 0 {
+		return stats
+	}
+
+	var total time.Duration
+	wins := make(map[leaderboardEntry]int)
+	names := make(map[string]string) // latest name per user id
+	for _, res := range results {
+		total += res.End.Sub(res.Start)
+		for side := 0; side < 2; side++ {
+			if id := res.UserIDs[side]; id != "" {
+				names[id] = res.Players[side]
+			}
+		}
+		if res.Winner < 0 || res.Winner > 1 {
+			continue
+		}
+		key := leaderboardEntry{UserID: res.UserIDs[res.Winner]}
+		if key.UserID == "" {
+			key.Name = res.Players[res.Winner]
+			if key.Name == "" || key.Name == "bot" {
+				continue
+			}
+		}
+		wins[key]++
+	}
+	stats.AvgSeconds = total.Seconds() / float64(len(results))
+
+	for e, n := range wins {
+		if e.UserID != "" {
+			e.Name = names[e.UserID]
+		}
+		e.Wins = n
+		stats.Leaderboard = append(stats.Leaderboard, e)
+	}
+	sort.Slice(stats.Leaderboard, func(i, j int) bool {
+		a, b := stats.Leaderboard[i], stats.Leaderboard[j]
+		if a.Wins != b.Wins {
+			return a.Wins > b.Wins
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.UserID < b.UserID
+	})
+	if len(stats.Leaderboard) > leaderboardSize {
+		stats.Leaderboard = stats.Leaderboard[:leaderboardSize]
+	}
+	return stats
+}
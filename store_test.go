@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStoreSkipsTornLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.jsonl")
+	// A good record, then one cut off by a crash mid-write.
+	if err := os.WriteFile(path, []byte(`{"roomId":"room-1","winner":0}`+"\n"+`{"roomId":"room-2","win`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Record(MatchResult{RoomID: "room-3", Winner: 1})
+	s.f.Close()
+
+	// Reopened, the store still reads every whole record.
+	s, err = newFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.f.Close()
+	all, err := s.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, res := range all {
+		ids = append(ids, res.RoomID)
+	}
+	if len(ids) != 2 || ids[0] != "room-1" || ids[1] != "room-3" {
+		t.Errorf("results %v, want [room-1 room-3]", ids)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import "strconv"
+
+// parseSwapSides reads a SWAP_SIDES setting: "off", "set" to swap after
+// every set, or a positive number of points between swaps.
+func parseSwapSides(s string) (perSet bool, points int, ok bool) {
+	switch s {
+	case "off":
+		return false, 0, true
+	case "set":
+		return true, 0, true
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return false, 0, false
+	}
+	return false, n, true
+}
+
+// swapSidesLocked moves each player to the other paddle, taking their score,
+// sets and per-side state with them. The swapped players are queued for a
+// fresh hello so they pick up their new side.
+func (r *room) swapSidesLocked() {
+	r.players[0], r.players[1] = r.players[1], r.players[0]
+	r.bot[0], r.bot[1] = r.bot[1], r.bot[0]
+	r.botTargetY[0], r.botTargetY[1] = r.botTargetY[1], r.botTargetY[0]
+	r.botThink[0], r.botThink[1] = r.botThink[1], r.botThink[0]
+	r.away[0], r.away[1] = r.away[1], r.away[0]
+	r.graceTimer[0], r.graceTimer[1] = r.graceTimer[1], r.graceTimer[0]
+	r.paddleY[0], r.paddleY[1] = r.paddleY[1], r.paddleY[0]
+	r.paddleLen[0], r.paddleLen[1] = r.paddleLen[1], r.paddleLen[0]
+	// A handicap belongs to the player, not the paddle.
+	r.rules.PaddleScale[0], r.rules.PaddleScale[1] = r.rules.PaddleScale[1], r.rules.PaddleScale[0]
+	for i := range r.effects {
+		r.effects[i].side = 1 - r.effects[i].side
+	}
+	for i := range r.balls {
+		if r.balls[i].lastHit >= 0 {
+			r.balls[i].lastHit = 1 - r.balls[i].lastHit
+		}
+	}
+	r.score[0], r.score[1] = r.score[1], r.score[0]
+	r.setsWon[0], r.setsWon[1] = r.setsWon[1], r.setsWon[0]
+	r.ready[0], r.ready[1] = r.ready[1], r.ready[0]
+	r.afkWarned[0], r.afkWarned[1] = r.afkWarned[1], r.afkWarned[0]
+	r.rematch[0], r.rematch[1] = r.rematch[1], r.rematch[0]
+	r.seats[0], r.seats[1] = r.seats[1], r.seats[0]
+
+	for side := 0; side < 2; side++ {
+		p := r.players[side]
+		if p == nil {
+			continue
+		}
+		p.setSeat(r, side)
+		// Away players have no connection; resume sends their hello.
+		if !r.away[side] {
+			r.rehello = append(r.rehello, p)
+		}
+	}
+	r.outbox = append(r.outbox, wsOut{Type: "sides_swapped"})
+	r.outbox = append(r.outbox, wsOut{Type: "players", Data: r.playerNamesLocked()})
+}
+
+// takeRehello returns and clears the players owed a fresh hello.
+func (r *room) takeRehello() []*client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := r.rehello
+	r.rehello = nil
+	return out
+}
@@ -0,0 +1,44 @@
+package main
+
+// maxTimeline caps a match's score timeline. When it fills, every other
+// sample is dropped and sampling slows to match, so a long match keeps an
+// even, coarser series.
+const maxTimeline = 600
+
+// scoreSample is one point of a match's score timeline.
+type scoreSample struct {
+	T     int    `json:"t"`     // seconds of play since the first serve
+	Score [2]int `json:"score"` // in the current set
+	Sets  [2]int `json:"sets"`
+	Rally int    `json:"rally"` // paddle hits so far in the current rally
+}
+
+// sampleLocked appends to the timeline every timelineStride seconds of play.
+// It runs on ticks, like the rest of the match, so pauses don't show up as
+// gaps.
+func (r *room) sampleLocked() {
+	if r.timelineStride == 0 {
+		r.timelineStride = 1
+	}
+	every := r.timelineStride * r.cfg.tickRate
+	if r.tick%every != 0 {
+		return
+	}
+	if len(r.timeline) == maxTimeline {
+		kept := r.timeline[:0]
+		for i := 1; i < len(r.timeline); i += 2 {
+			kept = append(kept, r.timeline[i])
+		}
+		r.timeline = kept
+		r.timelineStride *= 2
+		if r.tick%(every*2) != 0 {
+			return
+		}
+	}
+	r.timeline = append(r.timeline, scoreSample{
+		T:     r.tick / r.cfg.tickRate,
+		Score: r.score,
+		Sets:  r.setsWon,
+		Rally: r.rallyHits,
+	})
+}
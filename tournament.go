@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxEntrants caps the size of a tournament.
+const maxEntrants = 64
+
+// A tournament is forgotten tournamentKeep after its final, or
+// tournamentMaxAge after it was created if it never finishes.
+const (
+	tournamentKeep   = time.Hour
+	tournamentMaxAge = 24 * time.Hour
+)
+
+// bracketMatch is one match in a tournament bracket.
+type bracketMatch struct {
+	// Players are the entrants' names, seat 0 first; empty until the
+	// match that feeds the seat is decided.
+	Players [2]string `json:"players"`
+	// RoomID and Code are set once both players are known and a room has
+	// been reserved for them. Each joins with the code and their token.
+	RoomID string `json:"roomId,omitempty"`
+	Code   string `json:"code,omitempty"`
+	// Winner is the winning seat, or -1 while undecided.
+	Winner int  `json:"winner"`
+	Bye    bool `json:"bye,omitempty"` // decided without being played
+}
+
+// tournament is a single-elimination bracket. Rounds[0] is the first round;
+// the winner of Rounds[i][j] takes seat j%2 of Rounds[i+1][j/2].
+type tournament struct {
+	ID        string            `json:"id"`
+	Entrants  []string          `json:"entrants"` // in seed order
+	Rounds    [][]*bracketMatch `json:"rounds"`
+	Champion  string            `json:"champion,omitempty"`
+	CreatedAt time.Time         `json:"createdAt"`
+	rules     roomConfig
+	// finishedAt is when the final was decided, zero until then.
+	finishedAt time.Time
+	// tokens is each entrant's seat token, by name. Only the response
+	// that creates the tournament shows them.
+	tokens map[string]string
+}
+
+// tournamentBook holds the server's tournaments. Its lock is taken before
+// hub.mu, since advancing a bracket reserves rooms.
+type tournamentBook struct {
+	mu     sync.Mutex
+	nextID int
+	byID   map[string]*tournament
+}
+
+func newTournamentBook() *tournamentBook {
+	return &tournamentBook{byID: make(map[string]*tournament)}
+}
+
+var (
+	errEntrants        = fmt.Errorf("a tournament needs 2 to %d players with distinct names", maxEntrants)
+	errTournamentRooms = errors.New("too many tournament matches under way, try again later")
+)
+
+// bracketOrder returns the seeds, 0 first, in bracket position order for a
+// bracket of size slots, so that the top seeds meet as late as possible.
+func bracketOrder(size int) []int {
+	order := []int{0}
+	for len(order) < size {
+		n := 2 * len(order)
+		next := make([]int, 0, n)
+		for _, s := range order {
+			next = append(next, s, n-1-s)
+		}
+		order = next
+	}
+	return order
+}
+
+// create registers a tournament for names, in seed order, and reserves
+// rooms for its first round. Top seeds get byes when the field isn't a power
+// of two. Tournament matches may hold at most cfg.maxTourRooms rooms between
+// them, so brackets can't crowd out everyone else; later rounds never need
+// more rooms than the matches that feed them free.
+func (tb *tournamentBook) create(h *hub, names []string, rc roomConfig) (*tournament, error) {
+	entrants := make([]string, 0, len(names))
+	seen := make(map[string]bool)
+	for _, n := range names {
+		n = sanitizeName(n)
+		key := strings.ToLower(n)
+		if n == "" || seen[key] {
+			return nil, errEntrants
+		}
+		seen[key] = true
+		entrants = append(entrants, n)
+	}
+	if len(entrants) < 2 || len(entrants) > maxEntrants {
+		return nil, errEntrants
+	}
+
+	size := 2
+	for size < len(entrants) {
+		size *= 2
+	}
+	t := &tournament{Entrants: entrants, CreatedAt: time.Now(), rules: rc, tokens: make(map[string]string)}
+	for _, n := range entrants {
+		t.tokens[n] = newResumeToken()
+	}
+	for n := size / 2; n >= 1; n /= 2 {
+		round := make([]*bracketMatch, n)
+		for i := range round {
+			round[i] = &bracketMatch{Winner: -1}
+		}
+		t.Rounds = append(t.Rounds, round)
+	}
+	order := bracketOrder(size)
+	need := 0
+	for i, m := range t.Rounds[0] {
+		for seat := 0; seat < 2; seat++ {
+			if seed := order[2*i+seat]; seed < len(entrants) {
+				m.Players[seat] = entrants[seed]
+			}
+		}
+		if m.Players[1] != "" {
+			need++
+		}
+	}
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.evictLocked(t.CreatedAt)
+	if tb.openRoomsLocked()+need > h.cfg.maxTourRooms {
+		return nil, errTournamentRooms
+	}
+	tb.nextID++
+	t.ID = fmt.Sprintf("t-%d", tb.nextID)
+	for i, m := range t.Rounds[0] {
+		if m.Players[1] == "" {
+			m.Bye = true
+			t.advanceLocked(h, 0, i, 0)
+			continue
+		}
+		if err := t.openLocked(h, 0, i); err != nil {
+			t.release(h)
+			return nil, err
+		}
+	}
+	tb.byID[t.ID] = t
+	return t, nil
+}
+
+// openLocked reserves a room for a match whose players are both known. The
+// room seats each player by their token and reports its result back to t.
+func (t *tournament) openLocked(h *hub, round, i int) error {
+	m := t.Rounds[round][i]
+	r, err := h.reserveRoom(t.rules, "")
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.seats = [2]string{t.tokens[m.Players[0]], t.tokens[m.Players[1]]}
+	r.onFinish = func(winner int) {
+		h.tournaments.mu.Lock()
+		defer h.tournaments.mu.Unlock()
+		// An evicted bracket has nobody left to report to.
+		if h.tournaments.byID[t.ID] != t {
+			return
+		}
+		// A drawn match sends the first seat through.
+		t.advanceLocked(h, round, i, max(winner, 0))
+	}
+	r.mu.Unlock()
+	m.RoomID, m.Code = r.id, r.code
+	return nil
+}
+
+// release closes the rooms reserved for t's matches without reporting
+// them to the bracket, for a tournament that failed to start.
+func (t *tournament) release(h *hub) {
+	for _, round := range t.Rounds {
+		for _, m := range round {
+			h.mu.Lock()
+			r := h.rooms[m.RoomID]
+			h.mu.Unlock()
+			if r == nil {
+				continue
+			}
+			r.mu.Lock()
+			r.onFinish = nil
+			r.mu.Unlock()
+			h.closeRoom(r, "cancelled")
+		}
+	}
+}
+
+// advanceLocked records winner as the result of Rounds[round][i] and moves
+// them on, opening the next match once both its players are known. Only the
+// first result of a match counts, so a rematch in its room changes nothing.
+func (t *tournament) advanceLocked(h *hub, round, i, winner int) {
+	m := t.Rounds[round][i]
+	if m.Winner >= 0 {
+		return
+	}
+	m.Winner = winner
+	name := m.Players[winner]
+	if round == len(t.Rounds)-1 {
+		t.Champion = name
+		t.finishedAt = time.Now()
+		return
+	}
+	next := t.Rounds[round+1][i/2]
+	next.Players[i%2] = name
+	if next.Players[0] == "" || next.Players[1] == "" {
+		return
+	}
+	if err := t.openLocked(h, round+1, i/2); err != nil {
+		log.Printf("tournament %s: round %d match %d: %v", t.ID, round+2, i/2+1, err)
+	}
+}
+
+// evictLocked forgets the tournaments that are past tournamentKeep or
+// tournamentMaxAge at now. Rooms an abandoned bracket still holds close on
+// their own once their reservation runs out.
+func (tb *tournamentBook) evictLocked(now time.Time) {
+	for id, t := range tb.byID {
+		done := !t.finishedAt.IsZero() && now.Sub(t.finishedAt) >= tournamentKeep
+		if done || now.Sub(t.CreatedAt) >= tournamentMaxAge {
+			delete(tb.byID, id)
+		}
+	}
+}
+
+// openRoomsLocked is how many rooms the tournaments hold for matches not yet
+// decided.
+func (tb *tournamentBook) openRoomsLocked() int {
+	n := 0
+	for _, t := range tb.byID {
+		for _, round := range t.Rounds {
+			for _, m := range round {
+				if m.RoomID != "" && m.Winner < 0 {
+					n++
+				}
+			}
+		}
+	}
+	return n
+}
+
+// snapshot returns a copy of the tournament t for encoding outside tb.mu.
+func (tb *tournamentBook) snapshot(id string) (tournament, bool) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	t := tb.byID[id]
+	if t == nil {
+		return tournament{}, false
+	}
+	out := *t
+	out.Rounds = make([][]*bracketMatch, len(t.Rounds))
+	for i, round := range t.Rounds {
+		out.Rounds[i] = make([]*bracketMatch, len(round))
+		for j, m := range round {
+			c := *m
+			out.Rounds[i][j] = &c
+		}
+	}
+	return out, true
+}
+
+// tournamentOut is the response to POST /tournaments: the bracket, and each
+// entrant's token, by name, for them to join their matches with.
+type tournamentOut struct {
+	tournament
+	Tokens map[string]string `json:"tokens"`
+}
+
+// tournamentIn is the body of POST /tournaments: the entrants' names in seed
+// order, and optionally the same tuning "create" accepts.
+type tournamentIn struct {
+	Players []string `json:"players"`
+	wsInCreate
+}
+
+// handleCreateTournament registers a tournament and reserves rooms for its
+// first round. It is guarded like POST /matches.
+func handleCreateTournament(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if _, ok := allowedOrigins[origin]; !ok {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+	}
+	if globalHub.auth != nil {
+		if _, err := globalHub.auth.Verify(bearerToken(r)); err != nil {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	var in tournamentIn
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&in); err != nil {
+		http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	rc, err := in.rules(globalHub.cfg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t, err := globalHub.tournaments.create(globalHub, in.Players, rc)
+	switch {
+	case errors.Is(err, errEntrants):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	out, _ := globalHub.tournaments.snapshot(t.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(tournamentOut{out, out.tokens})
+}
+
+func handleTournament(w http.ResponseWriter, r *http.Request) {
+	t, ok := globalHub.tournaments.snapshot(r.PathValue("id"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(t)
+}
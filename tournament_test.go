@@ -0,0 +1,156 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTournamentSeatNeedsToken(t *testing.T) {
+	h := newHub(defaultConfig(), &memoryStore{})
+	tour, err := h.tournaments.create(h, []string{"alice", "bob"}, defaultRoomConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := tour.Rounds[0][0]
+
+	join := func(id, name, seat string) *client {
+		c := &client{id: id, name: name, side: -1, send: make(chan outFrame, 8)}
+		c.mouseY.Store(mouseUnused)
+		if err := h.joinByRoomID(c, m.Code, -1, "", seat); err != nil {
+			t.Fatalf("%s: %v", id, err)
+		}
+		return c
+	}
+	// Knowing an entrant's name, or guessing at a token, isn't enough.
+	if c := join("impostor", "alice", ""); c.side != -1 {
+		t.Errorf("a client named alice with no token took side %d", c.side)
+	}
+	if c := join("guesser", "alice", tour.tokens["alice"]+"x"); c.side != -1 {
+		t.Errorf("a wrong token took side %d", c.side)
+	}
+	if c := join("alice", "anything", tour.tokens["alice"]); c.side != 0 {
+		t.Errorf("alice's token seated side %d, want 0", c.side)
+	}
+	if c := join("bob", "bob", tour.tokens["bob"]); c.side != 1 {
+		t.Errorf("bob's token seated side %d, want 1", c.side)
+	}
+}
+
+func TestTournamentNoShowForfeits(t *testing.T) {
+	h, url := startServer(t, defaultConfig())
+	tour, err := h.tournaments.create(h, []string{"alice", "bob"}, defaultRoomConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := h.rooms[tour.Rounds[0][0].RoomID]
+	conn := dialWS(t, url)
+	join := map[string]any{"roomId": r.code, "seat": tour.tokens["bob"]}
+	if err := conn.WriteJSON(map[string]any{"type": "join", "data": join}); err != nil {
+		t.Fatal(err)
+	}
+	// The hello that follows the join means bob is seated.
+	for {
+		var msg struct {
+			Type string `json:"type"`
+			Data struct {
+				Side int `json:"side"`
+			} `json:"data"`
+		}
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == "hello" && msg.Data.Side == 1 {
+			break
+		}
+	}
+
+	// Alice never comes.
+	expired := r.reservedUntil.Add(time.Second)
+	if r.idle(r.reservedUntil.Add(-time.Second)) {
+		t.Fatal("room closed before its reservation ran out")
+	}
+	if !r.idle(expired) {
+		t.Fatal("room kept open after the reservation ran out with a seat empty")
+	}
+	h.closeRoom(r, "idle")
+	waitFor(t, "the bracket to advance", func() bool {
+		got, _ := h.tournaments.snapshot(tour.ID)
+		return got.Champion != ""
+	})
+	got, _ := h.tournaments.snapshot(tour.ID)
+	if got.Champion != "bob" {
+		t.Errorf("champion %q, want bob, who showed up", got.Champion)
+	}
+}
+
+func TestTournamentCreateFailureReleasesRooms(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.maxRooms = 2
+	h := newHub(cfg, &memoryStore{})
+	// Four first-round matches, but room for only two.
+	names := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	if _, err := h.tournaments.create(h, names, defaultRoomConfig()); err == nil {
+		t.Fatal("created a tournament without rooms for its first round")
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if n := len(h.rooms); n != 0 {
+		t.Errorf("%d rooms still reserved after the failed create", n)
+	}
+}
+
+func TestTournamentRoomCap(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.maxTourRooms = 3
+	h := newHub(cfg, &memoryStore{})
+	four := []string{"a", "b", "c", "d"}
+	first, err := h.tournaments.create(h, four, defaultRoomConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.tournaments.create(h, four, defaultRoomConfig()); err != errTournamentRooms {
+		t.Fatalf("a second bracket past the cap: err %v, want %v", err, errTournamentRooms)
+	}
+	// A bye holds no room, so three entrants fit in the one left.
+	if _, err := h.tournaments.create(h, []string{"x", "y", "z"}, defaultRoomConfig()); err != nil {
+		t.Fatalf("a bracket needing one room: %v", err)
+	}
+
+	// Deciding a match frees its room toward the cap.
+	h.tournaments.mu.Lock()
+	first.advanceLocked(h, 0, 0, 0)
+	h.tournaments.mu.Unlock()
+	if _, err := h.tournaments.create(h, []string{"p", "q"}, defaultRoomConfig()); err != nil {
+		t.Fatalf("after a match was decided: %v", err)
+	}
+}
+
+func TestTournamentEviction(t *testing.T) {
+	h := newHub(defaultConfig(), &memoryStore{})
+	create := func() *tournament {
+		tour, err := h.tournaments.create(h, []string{"alice", "bob"}, defaultRoomConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tour
+	}
+	finished, stale, recent := create(), create(), create()
+
+	h.tournaments.mu.Lock()
+	finished.advanceLocked(h, 0, 0, 1)
+	finished.finishedAt = finished.finishedAt.Add(-tournamentKeep)
+	stale.CreatedAt = stale.CreatedAt.Add(-tournamentMaxAge)
+	// Decided, but only just.
+	recent.advanceLocked(h, 0, 0, 0)
+	h.tournaments.mu.Unlock()
+	create()
+
+	for _, tc := range []struct {
+		tour *tournament
+		kept bool
+	}{{finished, false}, {stale, false}, {recent, true}} {
+		if _, ok := h.tournaments.snapshot(tc.tour.ID); ok != tc.kept {
+			t.Errorf("%s (champion %q): kept = %v, want %v", tc.tour.ID, tc.tour.Champion, ok, tc.kept)
+		}
+	}
+}
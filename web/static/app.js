@@ -3,6 +3,11 @@
   const canvas = document.getElementById('c')
   const ctx = canvas.getContext('2d')
   const keysEl = document.getElementById('keys')
+  const feedEl = document.getElementById('feed')
+  const chatForm = document.getElementById('chat')
+  const chatInput = document.getElementById('chatInput')
+  const chatLog = document.getElementById('chatLog')
+  const reactionsEl = document.getElementById('reactions')
 
   const state = {
     hello: null,
@@ -11,11 +16,36 @@
       ballX: 400,
       ballY: 300,
       score: [0, 0],
+      sets: [0, 0],
       running: false,
+      phase: 'waiting',
+      ready: [false, false],
+      countdown: 0,
       secondsLeft: 0,
-      spectators: [],
     },
 
+    // Spectator names, from hello and then "spectators" events.
+    spectators: [],
+
+    // Spectators queued to play, front first, from hello and "next_up".
+    nextUp: [],
+
+    // Each side's paddle color, from hello and player events.
+    colors: ['', ''],
+
+    // Each side's player name, from hello, player events and "players".
+    players: ['', ''],
+
+    // Final result once the server sends "gameover".
+    gameover: null,
+
+    // The room's last few finished matches, from hello and "recent".
+    recent: [],
+
+    // The last "scored" event and when it arrived, for a goal flash.
+    scored: null,
+    scoredAt: 0,
+
     // For smoothing/interpolation.
     lastServerState: null,
     lastServerAt: 0,
@@ -32,12 +62,143 @@
     return 'Spectating/Waiting…'
   }
 
+  // Recent room activity, newest last.
+  const feed = []
+
+  function pushFeed(text) {
+    feed.push(text)
+    if (feed.length > 5) feed.shift()
+    feedEl.textContent = feed.join(' · ')
+  }
+
+  function describeEvent(ev) {
+    const where = ev.side === 0 ? ' (left)' : ev.side === 1 ? ' (right)' : ''
+    switch (ev.kind) {
+      case 'player_joined':
+        return `${ev.name} joined${where}`
+      case 'player_left':
+        return `${ev.name} left${where}`
+      case 'spectator_joined':
+        return `${ev.name} is watching`
+      case 'spectator_left':
+        return `${ev.name} stopped watching`
+      case 'spectator_kicked':
+        return `${ev.name} was removed by the host`
+      case 'spectator_promoted':
+        return `${ev.name} stepped in${where}`
+    }
+    return ''
+  }
+
+  // Opt in to compact binary state frames with ?binary.
+  const useBinary = new URLSearchParams(location.search).has('binary')
+
   function wsURL() {
     const proto = location.protocol === 'https:' ? 'wss' : 'ws'
-    return `${proto}://${location.host}/ws`
+    const q = new URLSearchParams()
+    if (useBinary) q.set('format', 'binary')
+    // A sign-in token from the page URL is passed through to the server.
+    const token = new URLSearchParams(location.search).get('token')
+    if (token) q.set('token', token)
+    // A reconnecting client names its token, so the server hands back its
+    // slot or seat before matchmaking can pair it with someone else.
+    if (resumeToken || watchToken) q.set('resume', resumeToken || watchToken)
+    // Room links join on connect, saving a round trip. Locked rooms are
+    // joined in onopen, to keep the password out of the WebSocket URL.
+    const { roomId, name, color, play, side, password } = getParams()
+    if (roomId && !password && !resumeToken && !watchToken) {
+      q.set('room', roomId)
+      if (side !== undefined) q.set('side', side)
+      if (name) q.set('name', name)
+      if (color) q.set('color', color)
+      if (play) q.set('play', '')
+    }
+    const qs = q.toString()
+    return `${proto}://${location.host}/ws${qs ? '?' + qs : ''}`
+  }
+
+  const phases = ['waiting', 'countdown', 'playing', 'finished', 'paused']
+  const powerupKinds = ['grow', 'shrink', 'slow']
+  const powerupColors = {
+    grow: 'rgba(120,220,140,0.6)',
+    shrink: 'rgba(240,120,120,0.6)',
+    slow: 'rgba(120,170,250,0.6)',
+  }
+
+  // Paddle colors by the names the server accepts.
+  const paddleColors = {
+    white: 'rgba(255,255,255,0.85)',
+    red: '#f26d6d',
+    orange: '#f5a25d',
+    yellow: '#f2d95c',
+    green: '#7bd88f',
+    cyan: '#6fd6e3',
+    blue: '#6f9bf2',
+    purple: '#b28af2',
+    pink: '#f28ad2',
+  }
+
+  // Decodes a binary state frame; see appendBinary in game.go for the layout.
+  function decodeBinaryState(buf) {
+    const v = new DataView(buf)
+    if (v.byteLength < 55 || v.getUint8(0) !== 1) return null
+    let off = 44
+    const powerups = []
+    for (let n = v.getUint8(43); n > 0 && off + 9 < v.byteLength; n--, off += 9) {
+      powerups.push({ kind: powerupKinds[v.getUint8(off)], x: v.getFloat32(off + 1, true), y: v.getFloat32(off + 5, true) })
+    }
+    const balls = []
+    const ballCount = v.getUint8(off++)
+    for (let n = ballCount; n > 0 && off + 16 <= v.byteLength; n--, off += 16) {
+      balls.push({
+        x: v.getFloat32(off, true),
+        y: v.getFloat32(off + 4, true),
+        vx: v.getFloat32(off + 8, true),
+        vy: v.getFloat32(off + 12, true),
+      })
+    }
+    const flags = v.getUint8(21)
+    return {
+      type: 'state',
+      data: {
+        paddleY: [v.getFloat32(1, true), v.getFloat32(5, true)],
+        ballX: v.getFloat32(9, true),
+        ballY: v.getFloat32(13, true),
+        score: [v.getUint16(17, true), v.getUint16(19, true)],
+        running: (flags & 1) !== 0,
+        overtime: (flags & 2) !== 0,
+        ready: [(flags & 4) !== 0, (flags & 8) !== 0],
+        phase: phases[(flags >> 4) & 7],
+        secondsLeft: v.getUint16(22, true),
+        countdown: v.getUint8(24),
+        ballVX: v.getFloat32(25, true),
+        ballVY: v.getFloat32(29, true),
+        serverTime: v.getUint32(33, true),
+        sets: [v.getUint8(37), v.getUint8(38)],
+        paddleH: [v.getUint16(39, true), v.getUint16(41, true)],
+        elapsedSeconds: off + 2 <= v.byteLength ? v.getUint16(off, true) : 0,
+        ackSeq: off + 10 <= v.byteLength ? [v.getUint32(off + 2, true), v.getUint32(off + 6, true)] : [0, 0],
+        rally: off + 12 <= v.byteLength ? v.getUint16(off + 10, true) : 0,
+        longestRally: off + 14 <= v.byteLength ? v.getUint16(off + 12, true) : 0,
+        serving: off + 15 <= v.byteLength && v.getInt8(off + 14) !== 0,
+        serveDir: off + 15 <= v.byteLength ? v.getInt8(off + 14) : 0,
+        ballSpeed: off + 17 <= v.byteLength ? v.getUint16(off + 15, true) : 0,
+        latency: off + 21 <= v.byteLength ? [v.getUint16(off + 17, true), v.getUint16(off + 19, true)] : [0, 0],
+        powerups,
+        balls: balls.length ? balls : undefined,
+      },
+    }
   }
 
   let ws
+  // Token from the last hello, used to reclaim our slot after a drop.
+  let resumeToken = ''
+  // A spectator's token, kept across a drop to get back to the same room.
+  let watchToken = ''
+  // Set when the server announces a restart so the close isn't shown as an error.
+  let shuttingDown = false
+  // Set when the server closes our room for inactivity; we stay disconnected.
+  let roomClosed = false
 
   function send(type, data) {
     if (!ws || ws.readyState !== WebSocket.OPEN) return
@@ -49,25 +210,63 @@
     return {
       roomId: p.get('room') || '',
       name: p.get('name') || '',
+      color: p.get('color') || '',
+      create: p.has('create'),
+      // Paddles shrink as rallies run long, in a room made with ?create.
+      shrink: p.has('shrink'),
+      // Preferred paddle for ?create or ?room=: 0 left, 1 right.
+      side: ['0', '1'].includes(p.get('side')) ? Number(p.get('side')) : undefined,
+      practice: p.has('practice'),
+      watch: p.has('watch'),
+      // Spectators who'd take over if both players leave.
+      play: p.has('play'),
+      // Locks a room made with ?create, or unlocks the one in ?room=.
+      password: p.get('password') || '',
     }
   }
 
   function connect() {
-    ws = new WebSocket(wsURL())
+    // v2 state carries the input acks decoded above.
+    ws = new WebSocket(wsURL(), ['pong.v2'])
+    ws.binaryType = 'arraybuffer'
 
     ws.onopen = () => {
-      const { roomId, name } = getParams()
-      if (roomId) {
+      const { roomId, name, color, create, shrink, side, practice, watch, play, password } = getParams()
+      // A resume was asked for in the URL; hello says how it went.
+      if (resumeToken) {
+        statusEl.textContent = 'Connected. Resuming…'
+        resumeToken = ''
+      } else if (watchToken) {
+        statusEl.textContent = 'Connected. Rejoining room…'
+        watchToken = ''
+      } else if (roomId) {
+        // Joined through the URL unless the room is locked; hello says
+        // where we ended up.
         statusEl.textContent = 'Connected. Joining room…'
-        send('join', { roomId, name })
+        if (password) send('join', { roomId, name, color, play, side, password })
+      } else if (create) {
+        if (name || color) send('name', { name, color })
+        statusEl.textContent = 'Connected. Creating room…'
+        send('create', { shrink, side, password })
+      } else if (practice) {
+        if (name || color) send('name', { name, color })
+        statusEl.textContent = 'Connected. Starting practice…'
+        send('practice')
+      } else if (watch) {
+        statusEl.textContent = 'Connected. Finding a match to watch…'
+        send('spectate', { name, color, play })
       } else {
-        if (name) send('name', { name })
+        if (name || color) send('name', { name, color })
         statusEl.textContent = 'Connected. Pairing…'
       }
     }
 
     ws.onclose = () => {
-      statusEl.textContent = 'Disconnected. Reconnecting…'
+      if (roomClosed) return
+      if (!shuttingDown) statusEl.textContent = 'Disconnected. Reconnecting…'
+      shuttingDown = false
+      if (state.hello?.side === -1 && state.hello.roomId) watchToken = resumeToken
+      if (state.gameover || state.hello?.side === -1) resumeToken = ''
       state.hello = null
       setTimeout(connect, 800)
     }
@@ -78,22 +277,42 @@
 
     ws.onmessage = (ev) => {
       let msg
-      try {
-        msg = JSON.parse(ev.data)
-      } catch {
-        return
+      if (ev.data instanceof ArrayBuffer) {
+        msg = decodeBinaryState(ev.data)
+        if (!msg) return
+      } else {
+        try {
+          msg = JSON.parse(ev.data)
+        } catch {
+          return
+        }
       }
 
       if (msg.type === 'hello') {
         state.hello = msg.data
+        state.colors = msg.data.colors || ['', '']
+        state.players = msg.data.players || ['', '']
+        state.recent = msg.data.recent || []
+        state.spectators = msg.data.spectators || []
+        state.nextUp = msg.data.nextUp || []
+        resumeToken = state.hello.resumeToken || ''
+        // The server decides the world size; render in its coordinates.
+        if (state.hello.w && state.hello.h && (canvas.width !== state.hello.w || canvas.height !== state.hello.h)) {
+          canvas.width = state.hello.w
+          canvas.height = state.hello.h
+          canvas.style.aspectRatio = `${state.hello.w} / ${state.hello.h}`
+        }
         const s = state.hello.side
         keysEl.textContent = s === 0 ? 'use ' : s === 1 ? 'use ' : ''
         if (s === 0) keysEl.innerHTML = `<kbd>W</kbd>/<kbd>S</kbd>`
         if (s === 1) keysEl.innerHTML = `<kbd>↑</kbd>/<kbd>↓</kbd>`
         if (s === -1) keysEl.textContent = '(spectator/waiting)'
+        if (s === -1 && state.hello.roomId) keysEl.innerHTML = `(spectator) <kbd>Q</kbd> to queue to play`
         statusEl.textContent = `Room ${state.hello.roomId} — ${sideName(s)}`
+        if (state.hello.code) statusEl.textContent += ` — code ${state.hello.code}`
 
         // Reset smoothed ball for new room/game.
+        state.gameover = null
         state.lastServerState = null
         state.lastServerAt = 0
         state.render.ballX = state.game.ballX
@@ -133,11 +352,120 @@
          }
 
 
+        // A rematch restarts the match in place.
+        if (msg.data.phase !== 'finished' && state.gameover) {
+          state.gameover = null
+          statusEl.textContent = `Room ${state.hello?.roomId} — ${sideName(state.hello?.side)}`
+        }
+
         state.lastServerState = msg.data
         state.lastServerAt = performance.now()
       }
 
 
+      if (msg.type === 'spectators') {
+        state.spectators = msg.data
+      }
+
+      if (msg.type === 'next_up') {
+        state.nextUp = msg.data
+      }
+
+      if (msg.type === 'players') {
+        state.players = msg.data
+      }
+
+      if (msg.type === 'recent') {
+        state.recent = msg.data
+      }
+
+      if (msg.type === 'event') {
+        if (msg.data.kind.startsWith('player_') || msg.data.kind === 'spectator_promoted') {
+          const side = msg.data.side
+          if (side === 0 || side === 1) {
+            const left = msg.data.kind === 'player_left'
+            state.colors[side] = left ? '' : msg.data.color
+            state.players[side] = left ? '' : msg.data.name
+          }
+        }
+        const text = describeEvent(msg.data)
+        if (text) pushFeed(text)
+      }
+
+      if (msg.type === 'chat') {
+        const line = document.createElement('div')
+        line.textContent = `${msg.data.name}: ${msg.data.text}`
+        chatLog.appendChild(line)
+        while (chatLog.childNodes.length > 50) chatLog.removeChild(chatLog.firstChild)
+        chatLog.scrollTop = chatLog.scrollHeight
+      }
+
+      if (msg.type === 'reaction') {
+        pushFeed(`${msg.data.name}: ${msg.data.code}`)
+      }
+
+      if (msg.type === 'sides_swapped') {
+        pushFeed('Players changed ends')
+      }
+
+      if (msg.type === 'scored') {
+        state.scored = msg.data
+        state.scoredAt = performance.now()
+      }
+
+      if (msg.type === 'set_over') {
+        const who = msg.data.winner === 0 ? 'Left' : 'Right'
+        pushFeed(`${who} takes the set ${msg.data.score[0]}–${msg.data.score[1]}`)
+      }
+
+      if (msg.type === 'afk_warning') {
+        const who = msg.data.side === state.hello?.side ? 'You have' : `${msg.data.side === 0 ? 'Left' : 'Right'} has`
+        pushFeed(`${who} ${msg.data.seconds}s to move before forfeiting for inactivity`)
+      }
+
+      if (msg.type === 'afk') {
+        if (msg.data.side === state.hello?.side) {
+          roomClosed = true
+          statusEl.textContent = 'Removed for inactivity. Reload to play again.'
+        } else {
+          pushFeed(`${msg.data.side === 0 ? 'Left' : 'Right'} forfeits for inactivity`)
+        }
+      }
+
+      if (msg.type === 'gameover') {
+        state.gameover = msg.data
+      }
+
+      if (msg.type === 'rematch_pending') {
+        const side = state.hello?.side
+        const mine = side === 0 || side === 1 ? msg.data.ready[side] : false
+        statusEl.textContent = mine ? 'Waiting for opponent to accept rematch…' : 'Opponent wants a rematch (press R)'
+      }
+
+      if (msg.type === 'queue_full') {
+        statusEl.textContent = 'Server is full. Waiting for a free room…'
+      }
+
+      if (msg.type === 'kicked') {
+        roomClosed = true
+        statusEl.textContent = 'Removed from the room by its host.'
+      }
+
+      if (msg.type === 'server_shutdown') {
+        shuttingDown = true
+        statusEl.textContent = 'Server restarting. Reconnecting shortly…'
+      }
+
+      if (msg.type === 'room_closed') {
+        roomClosed = true
+        const why = {
+          idle: 'Room closed after being idle.',
+          match_ended: 'Match ended: both players left.',
+          gone: 'The room you were watching has closed.',
+        }
+        statusEl.textContent = `${why[msg.data.reason] || 'Room closed.'} Reload to play again.`
+      }
+
       if (msg.type === 'error') {
         statusEl.textContent = `Error: ${msg.data}`
       }
@@ -150,15 +478,25 @@
     return Math.max(0, Math.min(canvas.height, y))
   }
 
+  // Every move and mouse input carries a counter; the server echoes the last
+  // one it applied in state.ackSeq.
+  let inputSeq = 0
+
+  function sendInput(type, data) {
+    inputSeq = (inputSeq + 1) >>> 0
+    send(type, { ...data, seq: inputSeq })
+  }
+
   // Mouse/touch drag controls: only send while dragging.
   let dragging = false
 
   function sendDragY(clientY) {
     if (!dragging) return
-    send('mouse', { y: canvasToWorldY(clientY) })
+    sendInput('mouse', { y: canvasToWorldY(clientY) })
   }
 
   canvas.addEventListener('pointerdown', (e) => {
+    sendReady()
     dragging = true
     canvas.setPointerCapture(e.pointerId)
     sendDragY(e.clientY)
@@ -193,14 +531,14 @@
     function start(e) {
       e.preventDefault()
       holding = true
-      send('move', { dir })
+      sendInput('move', { dir })
     }
 
     function end(e) {
       e.preventDefault()
       if (!holding) return
       holding = false
-      send('move', { dir: 0 })
+      sendInput('move', { dir: 0 })
     }
 
     btn.addEventListener('pointerdown', start)
@@ -212,6 +550,18 @@
   bindHoldButton(btnUp, -1)
   bindHoldButton(btnDown, 1)
 
+  chatForm.addEventListener('submit', (e) => {
+    e.preventDefault()
+    const text = chatInput.value.trim()
+    if (text) send('chat', { text })
+    chatInput.value = ''
+  })
+
+  reactionsEl.addEventListener('click', (e) => {
+    const code = e.target.dataset?.code
+    if (code) send('react', { code })
+  })
+
   // Keyboard controls.
   const down = new Set()
 
@@ -229,15 +579,45 @@
       return
     }
 
-    send('move', { dir })
+    sendInput('move', { dir })
+  }
+
+  function isPlayer() {
+    const side = state.hello?.side
+    return side === 0 || side === 1
+  }
+
+  function sendReady() {
+    if (isPlayer() && state.game.phase === 'waiting' && !state.game.ready[state.hello.side]) send('ready')
   }
 
   window.addEventListener('keydown', (e) => {
+    // Don't steer while typing in chat.
+    if (e.target === chatInput) return
+    if (e.code === 'Space') {
+      e.preventDefault()
+      sendReady()
+      return
+    }
+    if (e.code === 'KeyL' && state.hello?.roomId) {
+      send('leave')
+      return
+    }
+    if (e.code === 'KeyR' && state.gameover) {
+      send('rematch')
+      return
+    }
+    if (e.code === 'KeyQ' && state.hello?.roomId && !isPlayer()) {
+      const queued = state.nextUp.some((q) => q.clientId === state.hello.clientId)
+      send('queue', { leave: queued })
+      return
+    }
     down.add(e.code)
     updateKeyboardDir()
   })
 
   window.addEventListener('keyup', (e) => {
+    if (e.target === chatInput) return
     down.delete(e.code)
     updateKeyboardDir()
   })
@@ -251,11 +631,18 @@
     if (!snap) return
 
     // Smooth toward the latest server state over ~60ms (snappier).
-    const alpha = Math.max(0, Math.min(1, (now - state.lastServerAt) / 10))
+    const since = now - state.lastServerAt
+    const alpha = Math.max(0, Math.min(1, since / 10))
+
+    // Dead-reckon from the last known velocity so a late packet doesn't
+    // freeze the ball; cap it so a stall doesn't fly off.
+    const ahead = Math.min(since, 100) / 1000
+    const targetX = snap.ballX + (snap.ballVX || 0) * ahead
+    const targetY = snap.ballY + (snap.ballVY || 0) * ahead
 
     // Only smooth the ball to reduce visual snaps under load.
-    state.render.ballX = lerp(state.render.ballX, snap.ballX, alpha)
-    state.render.ballY = lerp(state.render.ballY, snap.ballY, alpha)
+    state.render.ballX = lerp(state.render.ballX, targetX, alpha)
+    state.render.ballY = lerp(state.render.ballY, targetY, alpha)
   }
 
   function draw(now) {
@@ -264,6 +651,14 @@
 
     ctx.clearRect(0, 0, canvas.width, canvas.height)
 
+    // Flash the half the ball went out of, fading over half a second.
+    const sinceScored = now - state.scoredAt
+    if (state.scored && sinceScored < 500) {
+      ctx.fillStyle = `rgba(255,255,255,${0.15 * (1 - sinceScored / 500)})`
+      const x = state.scored.side === 0 ? canvas.width / 2 : 0
+      ctx.fillRect(x, 0, canvas.width / 2, canvas.height)
+    }
+
     // center line
     ctx.strokeStyle = 'rgba(255,255,255,0.15)'
     ctx.setLineDash([10, 10])
@@ -274,26 +669,79 @@
     ctx.setLineDash([])
 
     // paddles
-    const paddleW = 12
-    const paddleH = 90
-    const margin = 20
+    // The room's tuning arrives in hello; fall back to the server defaults.
+    const rules = state.hello?.rules || {}
+    const paddleW = rules.paddleW || 12
+    const paddleH = g.paddleH || [rules.paddleH || 90, rules.paddleH || 90]
+    const radius = rules.ballRadius || 8
+    const margin = state.hello?.margin ?? 20
+
+    // Binary frames don't carry colors; those come from hello and events.
+    const colors = g.colors || state.colors
+    for (const side of [0, 1]) {
+      ctx.fillStyle = paddleColors[colors[side]] || paddleColors.white
+      const x = side === 0 ? margin : canvas.width - margin - paddleW
+      ctx.fillRect(x, g.paddleY[side], paddleW, paddleH[side])
+    }
+    ctx.fillStyle = 'rgba(255,255,255,0.85)'
 
+    // power-ups
+    for (const p of g.powerups || []) {
+      ctx.beginPath()
+      ctx.arc(p.x, p.y, 16, 0, Math.PI * 2)
+      ctx.fillStyle = powerupColors[p.kind] || 'rgba(255,255,255,0.4)'
+      ctx.fill()
+    }
     ctx.fillStyle = 'rgba(255,255,255,0.85)'
-    ctx.fillRect(margin, g.paddleY[0], paddleW, paddleH)
-    ctx.fillRect(canvas.width - margin - paddleW, g.paddleY[1], paddleW, paddleH)
 
     // ball
     ctx.beginPath()
-    ctx.arc(state.render.ballX, state.render.ballY, 8, 0, Math.PI * 2)
+    ctx.arc(state.render.ballX, state.render.ballY, radius, 0, Math.PI * 2)
     ctx.fill()
+    // While the serve is held, point the way it will go.
+    if (g.serving && g.serveDir) {
+      const tip = state.render.ballX + g.serveDir * (radius + 22)
+      const base = state.render.ballX + g.serveDir * (radius + 8)
+      ctx.beginPath()
+      ctx.moveTo(tip, state.render.ballY)
+      ctx.lineTo(base, state.render.ballY - 7)
+      ctx.lineTo(base, state.render.ballY + 7)
+      ctx.closePath()
+      ctx.fill()
+    }
+    // Extra balls in multi-ball mode, extrapolated but not smoothed.
+    if (g.balls && state.lastServerState) {
+      const ahead = Math.min(now - state.lastServerAt, 100) / 1000
+      for (const b of g.balls.slice(1)) {
+        ctx.beginPath()
+        ctx.arc(b.x + b.vx * ahead, b.y + b.vy * ahead, radius, 0, Math.PI * 2)
+        ctx.fill()
+      }
+    }
 
     // score + timer
     ctx.fillStyle = 'rgba(255,255,255,0.9)'
     ctx.font = '28px ui-monospace, SFMono-Regular, Menlo, Monaco, Consolas, monospace'
     ctx.textAlign = 'center'
     ctx.fillText(`${g.score[0]}   ${g.score[1]}`, canvas.width / 2, 40)
+    ctx.font = '12px ui-monospace, SFMono-Regular, Menlo, Monaco, Consolas, monospace'
+    ctx.fillStyle = 'rgba(255,255,255,0.5)'
+    ctx.textAlign = 'right'
+    ctx.fillText(state.players[0], canvas.width / 2 - 40, 36)
+    ctx.textAlign = 'left'
+    ctx.fillText(state.players[1], canvas.width / 2 + 40, 36)
+    ctx.textAlign = 'center'
+    if (g.sets && g.sets[0] + g.sets[1] > 0) {
+      ctx.font = '12px ui-monospace, SFMono-Regular, Menlo, Monaco, Consolas, monospace'
+      ctx.fillStyle = 'rgba(255,255,255,0.5)'
+      ctx.fillText(`sets ${g.sets[0]}–${g.sets[1]}`, canvas.width / 2, 80)
+    }
 
-    if (typeof g.secondsLeft === 'number') {
+    if (g.overtime) {
+      ctx.font = '14px ui-monospace, SFMono-Regular, Menlo, Monaco, Consolas, monospace'
+      ctx.fillStyle = 'rgba(255,200,120,0.9)'
+      ctx.fillText('OVERTIME — next point wins', canvas.width / 2, 62)
+    } else if (typeof g.secondsLeft === 'number') {
       const m = Math.floor(g.secondsLeft / 60)
       const s = `${g.secondsLeft % 60}`.padStart(2, '0')
       ctx.font = '14px ui-monospace, SFMono-Regular, Menlo, Monaco, Consolas, monospace'
@@ -301,10 +749,87 @@
       ctx.fillText(`${m}:${s}`, canvas.width / 2, 62)
     }
 
-    if (!g.running) {
+    if (g.elapsedSeconds > 0) {
+      const m = Math.floor(g.elapsedSeconds / 60)
+      const s = `${g.elapsedSeconds % 60}`.padStart(2, '0')
+      ctx.font = '12px ui-monospace, SFMono-Regular, Menlo, Monaco, Consolas, monospace'
+      ctx.fillStyle = 'rgba(255,255,255,0.4)'
+      ctx.textAlign = 'left'
+      ctx.fillText(`${m}:${s} played`, 10, 20)
+      ctx.textAlign = 'center'
+    }
+
+    if (isPlayer() && g.latency && g.latency[state.hello.side] > 0) {
+      ctx.font = '12px ui-monospace, SFMono-Regular, Menlo, Monaco, Consolas, monospace'
+      ctx.fillStyle = 'rgba(255,255,255,0.4)'
+      ctx.textAlign = 'right'
+      ctx.fillText(`${g.latency[state.hello.side]} ms`, canvas.width - 10, 20)
+      ctx.textAlign = 'center'
+    }
+
+    // Who plays next, so watchers know where they stand.
+    if (state.nextUp.length > 0) {
+      const names = state.nextUp.map((q, i) => {
+        const you = q.clientId === state.hello?.clientId ? ' (you)' : ''
+        return `${i + 1}. ${q.name}${you}`
+      })
+      ctx.font = '12px ui-monospace, SFMono-Regular, Menlo, Monaco, Consolas, monospace'
+      ctx.fillStyle = 'rgba(255,255,255,0.4)'
+      ctx.textAlign = 'right'
+      ctx.fillText(`next up: ${names.join('  ')}`, canvas.width - 10, 36)
+      ctx.textAlign = 'center'
+    }
+
+    // Speedometer, warning in red near the room's top speed.
+    if (g.phase === 'playing' && g.ballSpeed > 0) {
+      const top = state.hello?.rules?.maxBallSpeed || 0
+      ctx.font = '12px ui-monospace, SFMono-Regular, Menlo, Monaco, Consolas, monospace'
+      ctx.fillStyle = top && g.ballSpeed >= 0.9 * top ? 'rgba(242,109,109,0.8)' : 'rgba(255,255,255,0.4)'
+      ctx.textAlign = 'left'
+      ctx.fillText(`${Math.round(g.ballSpeed)} px/s`, 10, 36)
+      ctx.textAlign = 'center'
+    }
+
+    if (state.gameover) {
+      const r = state.gameover
+      const title = r.winner === 0 ? 'Left wins' : r.winner === 1 ? 'Right wins' : 'Draw'
+      ctx.fillStyle = 'rgba(255,255,255,0.85)'
+      ctx.font = '24px ui-sans-serif, system-ui'
+      ctx.fillText(`${title} ${r.score[0]}–${r.score[1]}`, canvas.width / 2, canvas.height / 2)
+      ctx.font = '14px ui-sans-serif, system-ui'
+      ctx.fillStyle = 'rgba(255,255,255,0.6)'
+      ctx.fillText(`Longest rally: ${r.longestRally || 0} hits`, canvas.width / 2, canvas.height / 2 + 28)
+      if (state.hello?.side === 0 || state.hello?.side === 1) {
+        ctx.fillText('Press R for a rematch', canvas.width / 2, canvas.height / 2 + 48)
+      }
+    } else if (g.phase === 'countdown') {
+      ctx.fillStyle = 'rgba(255,255,255,0.85)'
+      ctx.font = '64px ui-sans-serif, system-ui'
+      ctx.fillText(`${Math.max(1, g.countdown)}`, canvas.width / 2, canvas.height / 2 - 40)
+    } else if (g.phase === 'paused') {
+      ctx.fillStyle = 'rgba(255,255,255,0.7)'
+      ctx.font = '18px ui-sans-serif, system-ui'
+      ctx.fillText('Paused: a player’s connection is lagging…', canvas.width / 2, canvas.height / 2 - 40)
+    } else if (g.phase === 'waiting' && isPlayer()) {
       ctx.fillStyle = 'rgba(255,255,255,0.7)'
       ctx.font = '18px ui-sans-serif, system-ui'
-      ctx.fillText('Waiting for both players…', canvas.width / 2, canvas.height / 2)
+      const msg = g.ready[state.hello.side] ? 'Waiting for opponent to ready up…' : 'Press Space or tap when ready'
+      ctx.fillText(msg, canvas.width / 2, canvas.height / 2 - 40)
+    } else if (!g.running) {
+      ctx.fillStyle = 'rgba(255,255,255,0.7)'
+      ctx.font = '18px ui-sans-serif, system-ui'
+      ctx.fillText('Waiting for both players…', canvas.width / 2, canvas.height / 2 - 40)
+    }
+
+    // The series so far, so late arrivals have some context.
+    if (state.recent.length > 0) {
+      const results = state.recent.map((m) => {
+        const mark = m.winner === 0 ? '◀' : m.winner === 1 ? '▶' : '='
+        return `${m.score[0]}–${m.score[1]} ${mark}`
+      })
+      ctx.font = '12px ui-monospace, SFMono-Regular, Menlo, Monaco, Consolas, monospace'
+      ctx.fillStyle = 'rgba(255,255,255,0.4)'
+      ctx.fillText(`recent: ${results.join('  ')}`, canvas.width / 2, canvas.height - 12)
     }
 
     requestAnimationFrame((t) => draw(t))